@@ -55,11 +55,30 @@ func summarizeWithAI(model string) (string, error) {
             conflictNote = "\nConflicts: " + strings.Join(conflicts, ", ")
         }
     }
+    return requestAISummary(model, "You are summarizing code changes for a live checkpoint.", diff+conflictNote)
+}
+
+// summarizeDiffWithAI summarizes a precomputed name-status diff (e.g. between
+// HEAD and a checkpoint tree) instead of the pending worktree changes.
+func summarizeDiffWithAI(model, diff string) (string, error) {
+    diff = strings.TrimSpace(diff)
+    if diff == "" {
+        return "", nil
+    }
+    if os.Getenv("AIGIT_FAKE_AI_SUMMARY") != "" {
+        if s := nameStatusOneLiner(diff, nil); strings.TrimSpace(s) != "" {
+            return "AI: " + s, nil
+        }
+        return "AI: (auto)", nil
+    }
+    return requestAISummary(model, "You are writing the subject line for a git commit.", diff)
+}
 
-    prompt := "You are summarizing code changes for a live checkpoint.\n" +
+func requestAISummary(model, intro, diff string) (string, error) {
+    prompt := intro + "\n" +
         "Requirements: ONE single line, <= 15 words, imperative mood, present tense, no trailing punctuation. " +
         "Capture intent and key files. No quotes, no extra text.\n\n" +
-        "Changed files (git name-status):\n" + diff + conflictNote
+        "Changed files (git name-status):\n" + diff
 
     key := os.Getenv("OPENROUTER_API_KEY")
     if key == "" {
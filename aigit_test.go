@@ -3,12 +3,19 @@ package main
 import (
     "flag"
     "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
     "io"
     "os"
     "os/exec"
     "path/filepath"
+    "runtime"
+    "strconv"
     "strings"
+    "sync"
     "testing"
+    "time"
 )
 
 // --- Test helpers ---
@@ -96,7 +103,7 @@ func TestCheckpointListRestore(t *testing.T) {
     must(t, doCheckpoint("v2"))
 
     // Restore from first checkpoint
-    must(t, doRestore(sha1))
+    must(t, doRestore(sha1, restoreOptions{}))
     data, _ := os.ReadFile("foo.txt")
     if string(data) != "v1\n" {
         t.Fatalf("restore failed, foo.txt=%q", string(data))
@@ -179,7 +186,7 @@ func TestRemoteSyncAndApply(t *testing.T) {
     // Change local file and apply from remote (self)
     os.WriteFile("sync.txt", []byte("local diverged\n"), 0o644)
     uid := getUserID()
-    must(t, applyRemoteCheckpoint("origin", uid, ""))
+    must(t, applyRemoteCheckpoint("origin", uid, "", restoreOptions{}))
     data, _ := os.ReadFile("sync.txt")
     if string(data) != "remote v1\n" {
         t.Fatalf("apply did not restore remote content, got %q", string(data))
@@ -229,3 +236,1678 @@ func TestAISummaryCheckpoint(t *testing.T) {
         }
     }
 }
+
+func TestPublishCheckpoints(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    oldHead := runGit(t, repo, "rev-parse", "HEAD")
+    os.WriteFile("pub.txt", []byte("one\n"), 0o644)
+    must(t, doCheckpoint("Add pub"))
+    os.WriteFile("pub.txt", []byte("two\n"), 0o644)
+    must(t, doCheckpoint("Update pub"))
+    ref, err := ckRef()
+    must(t, err)
+
+    opts := publishOptions{Summary: "off"}
+    must(t, doPublish(opts))
+    if parent := runGit(t, repo, "rev-parse", "HEAD^"); parent != oldHead {
+        t.Fatalf("publish commit parent = %s, want %s", parent, oldHead)
+    }
+    if got, want := runGit(t, repo, "rev-parse", "HEAD^{tree}"), runGit(t, repo, "rev-parse", ref+"^{tree}"); got != want {
+        t.Fatalf("publish tree = %s, want checkpoint tree %s", got, want)
+    }
+    body := runGit(t, repo, "log", "-1", "--format=%B", "HEAD")
+    if !strings.HasPrefix(body, "Update pub") || !strings.Contains(body, "- Add pub") {
+        t.Fatalf("unexpected publish message:\n%s", body)
+    }
+
+    // The same range must not be published twice
+    head := runGit(t, repo, "rev-parse", "HEAD")
+    out := captureOutput(t, func() { must(t, doPublish(opts)) })
+    if !strings.Contains(out, "Nothing new to publish") || runGit(t, repo, "rev-parse", "HEAD") != head {
+        t.Fatalf("expected second publish to be a no-op, got:\n%s", out)
+    }
+
+    // New checkpoints are based on the published commit; moving HEAD refuses without --rebase
+    os.WriteFile("pub.txt", []byte("three\n"), 0o644)
+    must(t, doCheckpoint("Third pub"))
+    os.WriteFile("other.txt", []byte("x\n"), 0o644)
+    runGit(t, repo, "add", "other.txt")
+    runGit(t, repo, "commit", "-q", "-m", "other")
+    if err := doPublish(opts); err == nil || !strings.Contains(err.Error(), "--rebase") {
+        t.Fatalf("expected refusal when HEAD moved, got %v", err)
+    }
+    opts.Rebase = true
+    must(t, doPublish(opts))
+    if got := runGit(t, repo, "show", "HEAD:pub.txt"); got != "three" {
+        t.Fatalf("rebased publish pub.txt = %q", got)
+    }
+    if got := runGit(t, repo, "show", "HEAD:other.txt"); got != "x" {
+        t.Fatalf("rebased publish lost other.txt, got %q", got)
+    }
+
+    // --since takes any snapshot spec, e.g. a checkpoint name
+    os.WriteFile("pub.txt", []byte("four\n"), 0o644)
+    must(t, doCheckpoint("Fourth pub"))
+    must(t, createTag("ck", "mark"))
+    os.WriteFile("pub.txt", []byte("five\n"), 0o644)
+    must(t, doCheckpoint("Fifth pub"))
+    must(t, doPublish(publishOptions{Summary: "off", Since: "mark"}))
+    if body := runGit(t, repo, "log", "-1", "--format=%B", "HEAD"); !strings.HasPrefix(body, "Fifth pub") || strings.Contains(body, "Fourth pub") {
+        t.Fatalf("publish --since mark picked the wrong range:\n%s", body)
+    }
+}
+
+func TestDiffBetweenSnapshots(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("a.txt", []byte("one\n"), 0o644)
+    must(t, doCheckpoint("one"))
+    os.WriteFile("b.txt", []byte("two\n"), 0o644)
+    must(t, doCheckpoint("two"))
+    os.WriteFile("c.txt", []byte("untracked since last checkpoint\n"), 0o644)
+
+    // Default: latest checkpoint vs worktree, including untracked files
+    out := captureOutput(t, func() { must(t, doDiff(diffOptions{NameOnly: true})) })
+    if strings.TrimSpace(out) != "c.txt" {
+        t.Fatalf("diff since last checkpoint = %q, want c.txt", out)
+    }
+    // Relative specs between two checkpoints
+    opts, err := parseDiffArgs([]string{"ck~1", "ck", "--name-only"})
+    must(t, err)
+    out = captureOutput(t, func() { must(t, doDiff(opts)) })
+    if strings.TrimSpace(out) != "b.txt" {
+        t.Fatalf("diff ck~1 ck = %q, want b.txt", out)
+    }
+    if _, err := resolveRev("ck@{1h}"); err == nil {
+        t.Fatalf("expected no checkpoint older than an hour")
+    }
+}
+
+func TestRestoreExact(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile(".gitignore", []byte("*.log\n"), 0o644)
+    os.WriteFile("keep.txt", []byte("keep\n"), 0o644)
+    must(t, doCheckpoint("snapshot"))
+    ref, err := ckRef()
+    must(t, err)
+    sha := runGit(t, repo, "rev-parse", ref)
+
+    // After the snapshot: delete a checkpointed file, add an untracked file in a new dir and an ignored file
+    must(t, os.Remove("keep.txt"))
+    must(t, os.MkdirAll("newdir", 0o755))
+    os.WriteFile(filepath.Join("newdir", "later.txt"), []byte("later\n"), 0o644)
+    os.WriteFile("debug.log", []byte("ignored\n"), 0o644)
+
+    must(t, doRestore(sha, restoreOptions{Exact: true}))
+    if data, _ := os.ReadFile("keep.txt"); string(data) != "keep\n" {
+        t.Fatalf("keep.txt not restored, got %q", string(data))
+    }
+    if _, err := os.Stat("newdir"); !os.IsNotExist(err) {
+        t.Fatalf("expected newdir to be removed, stat err=%v", err)
+    }
+    if _, err := os.Stat("debug.log"); err != nil {
+        t.Fatalf("ignored file should be left alone: %v", err)
+    }
+}
+
+func TestUndoRestore(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("work.txt", []byte("v1\n"), 0o644)
+    must(t, doCheckpoint("v1"))
+    ref, err := ckRef()
+    must(t, err)
+    sha := runGit(t, repo, "rev-parse", ref)
+
+    // Uncommitted edits that a restore would clobber
+    os.WriteFile("work.txt", []byte("precious\n"), 0o644)
+    os.WriteFile("extra.txt", []byte("new\n"), 0o644)
+    must(t, doRestore(sha, restoreOptions{Exact: true}))
+    if _, err := os.Stat("extra.txt"); !os.IsNotExist(err) {
+        t.Fatalf("exact restore should have removed extra.txt")
+    }
+
+    out := captureOutput(t, func() { must(t, doUndoList(10)) })
+    if !strings.Contains(out, "restore "+sha[:7]) {
+        t.Fatalf("undo list missing restore entry:\n%s", out)
+    }
+    must(t, doUndo())
+    if data, _ := os.ReadFile("work.txt"); string(data) != "precious\n" {
+        t.Fatalf("undo did not bring back edits, work.txt=%q", string(data))
+    }
+    if data, _ := os.ReadFile("extra.txt"); string(data) != "new\n" {
+        t.Fatalf("undo did not bring back extra.txt, got %q", string(data))
+    }
+    if err := doUndo(); err == nil {
+        t.Fatalf("expected empty undo stack after popping the only entry")
+    }
+}
+
+func TestPathspecRestoreAndApply(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    must(t, os.MkdirAll("pkg", 0o755))
+    os.WriteFile(filepath.Join("pkg", "a.txt"), []byte("a1\n"), 0o644)
+    os.WriteFile("b.txt", []byte("b1\n"), 0o644)
+    must(t, doCheckpoint("v1"))
+    ref, err := ckRef()
+    must(t, err)
+    sha := runGit(t, repo, "rev-parse", ref)
+
+    os.WriteFile(filepath.Join("pkg", "a.txt"), []byte("a2\n"), 0o644)
+    os.WriteFile("b.txt", []byte("b2\n"), 0o644)
+    out := captureOutput(t, func() { must(t, doRestore(sha, restoreOptions{Paths: []string{"pkg"}})) })
+    if !strings.Contains(out, "Files:\n  M\tpkg/a.txt") {
+        t.Fatalf("expected touched files listing, got:\n%s", out)
+    }
+    if data, _ := os.ReadFile(filepath.Join("pkg", "a.txt")); string(data) != "a1\n" {
+        t.Fatalf("pkg/a.txt not restored, got %q", string(data))
+    }
+    if data, _ := os.ReadFile("b.txt"); string(data) != "b2\n" {
+        t.Fatalf("b.txt outside pathspec was touched, got %q", string(data))
+    }
+
+    // Partial apply from the remote is recorded as such
+    bare := filepath.Join(repo, "remote.git")
+    runGit(t, repo, "init", "--bare", bare)
+    runGit(t, repo, "remote", "add", "origin", bare)
+    must(t, pushCheckpoints("origin"))
+    must(t, fetchCheckpoints("origin"))
+    uid := getUserID()
+    must(t, applyRemoteCheckpoint("origin", uid, "", restoreOptions{Paths: []string{"b.txt"}}))
+    if data, _ := os.ReadFile("b.txt"); string(data) != "b1\n" {
+        t.Fatalf("b.txt not applied, got %q", string(data))
+    }
+    st, err := loadState()
+    must(t, err)
+    br, _ := currentBranch()
+    if got := st.Partial[key("origin", uid, br)]; len(got) != 1 || got[0] != "b.txt" {
+        t.Fatalf("expected partial apply recorded, got %v", got)
+    }
+}
+
+func TestGCRetention(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    runGit(t, repo, "config", "aigit.keep.recent", "3")
+    runGit(t, repo, "config", "aigit.keep.hourly", "0")
+    runGit(t, repo, "config", "aigit.keep.daily", "0")
+
+    ref, err := ckRef()
+    must(t, err)
+    var shas []string
+    for i := 0; i < 8; i++ {
+        os.WriteFile("gc.txt", []byte(strings.Repeat("x", i+1)), 0o644)
+        must(t, doCheckpoint("step"))
+        shas = append(shas, runGit(t, repo, "rev-parse", ref))
+    }
+    // Pin an old snapshot via a publish anchor; it must survive
+    runGit(t, repo, "update-ref", publishedRef(ref), shas[1])
+    tipTree := runGit(t, repo, "rev-parse", ref+"^{tree}")
+
+    must(t, doGC(false, false))
+    if n := runGit(t, repo, "rev-list", "--count", ref); n != "4" {
+        t.Fatalf("expected 4 retained snapshots (3 recent + pinned), got %s", n)
+    }
+    if got := runGit(t, repo, "rev-parse", ref+"^{tree}"); got != tipTree {
+        t.Fatalf("gc changed the tip tree")
+    }
+    anchor := runGit(t, repo, "rev-parse", publishedRef(ref))
+    if runGit(t, repo, "rev-parse", anchor+"^{tree}") != runGit(t, repo, "rev-parse", shas[1]+"^{tree}") {
+        t.Fatalf("publish anchor not remapped to the rewritten snapshot")
+    }
+    if _, err := exec.Command("git", "merge-base", "--is-ancestor", anchor, ref).Output(); err != nil {
+        t.Fatalf("remapped anchor is not on the rewritten chain")
+    }
+}
+
+func TestNamedCheckpoints(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    runGit(t, repo, "config", "aigit.keep.recent", "1")
+    runGit(t, repo, "config", "aigit.keep.hourly", "0")
+    runGit(t, repo, "config", "aigit.keep.daily", "0")
+
+    os.WriteFile("tag.txt", []byte("older\n"), 0o644)
+    must(t, doCheckpoint("older"))
+    os.WriteFile("tag.txt", []byte("before refactor\n"), 0o644)
+    must(t, doCheckpoint("before"))
+    must(t, createTag("ck", "pre-refactor"))
+    br, _ := currentBranch()
+    tagged := runGit(t, repo, "rev-parse", tagRef(br, "pre-refactor"))
+    for i := 0; i < 3; i++ {
+        os.WriteFile("tag.txt", []byte(strings.Repeat("after\n", i+1)), 0o644)
+        must(t, doCheckpoint("after"))
+    }
+
+    // Names resolve for restore and diff
+    out := captureOutput(t, func() { must(t, doDiff(diffOptions{Revs: []string{"pre-refactor", "ck"}, NameOnly: true})) })
+    if strings.TrimSpace(out) != "tag.txt" {
+        t.Fatalf("diff by tag name = %q", out)
+    }
+    must(t, doRestore("pre-refactor", restoreOptions{}))
+    if data, _ := os.ReadFile("tag.txt"); string(data) != "before refactor\n" {
+        t.Fatalf("restore by tag name failed, got %q", string(data))
+    }
+
+    // gc prunes only what is newer than the tag: the tagged snapshot and
+    // everything older stay on the chain as they were
+    ref, _ := ckRef()
+    must(t, doGC(false, false))
+    if got := runGit(t, repo, "rev-parse", tagRef(br, "pre-refactor")); got != tagged {
+        t.Fatalf("gc moved the tag to %s", got)
+    }
+    if n := runGit(t, repo, "rev-list", "--count", ref); n != "3" {
+        t.Fatalf("expected the tip, the tagged snapshot and the one before it after gc, got %s", n)
+    }
+    if got := runGit(t, repo, "rev-parse", ref+"~1"); got != tagged {
+        t.Fatalf("tagged snapshot rewritten on the chain: %s, want %s", got, tagged)
+    }
+    out = captureOutput(t, func() { must(t, doList(5, false)) })
+    if !strings.Contains(out, "[pre-refactor]") {
+        t.Fatalf("list lost the tag after gc:\n%s", out)
+    }
+
+    // Tags are pushed under the per-user namespace
+    bare := filepath.Join(repo, "remote.git")
+    runGit(t, repo, "init", "--bare", bare)
+    runGit(t, repo, "remote", "add", "origin", bare)
+    must(t, pushCheckpoints("origin"))
+    if got := runGit(t, bare, "rev-parse", userTagRemoteRef(getUserID(), br)+"/pre-refactor"); got != tagged {
+        t.Fatalf("remote tag = %s, want %s", got, tagged)
+    }
+}
+
+func TestJSONOutput(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("j.txt", []byte("one\n"), 0o644)
+    must(t, doCheckpoint("first"))
+    os.WriteFile("j.txt", []byte("two\n"), 0o644)
+    must(t, doCheckpoint("second"))
+    os.WriteFile("new.txt", []byte("pending\n"), 0o644)
+
+    var list []snapshotJSON
+    out := captureOutput(t, func() { must(t, doListJSON(10)) })
+    must(t, json.Unmarshal([]byte(out), &list))
+    if len(list) != 2 || list[0].Subject != "second" || len(list[0].FullSha) != 40 {
+        t.Fatalf("unexpected list json: %s", out)
+    }
+    if len(list[0].Files) != 1 || list[0].Files[0] != (fileJSON{Status: "M", Path: "j.txt"}) {
+        t.Fatalf("unexpected files in list json: %+v", list[0].Files)
+    }
+    if list[0].Trailers["Aigit-Merge"] != "no" {
+        t.Fatalf("expected trailers in list json, got %+v", list[0].Trailers)
+    }
+
+    var st statusJSON
+    out = captureOutput(t, func() { must(t, doStatusJSON()) })
+    must(t, json.Unmarshal([]byte(out), &st))
+    if st.Clean || st.LastCheckpoint == nil || st.LastCheckpoint.Subject != "second" {
+        t.Fatalf("unexpected status json: %s", out)
+    }
+
+    // Events stream as NDJSON with the snapshot attached to checkpoint lines
+    out = captureOutput(t, func() { must(t, doEvents("test", 50, false, true)) })
+    found := false
+    for _, ln := range strings.Split(strings.TrimSpace(out), "\n") {
+        var ev eventJSON
+        must(t, json.Unmarshal([]byte(ln), &ev))
+        if ev.Type == "checkpoint" && ev.Snapshot != nil && ev.Snapshot.Subject == "second" { found = true }
+    }
+    if !found {
+        t.Fatalf("expected checkpoint event with snapshot, got:\n%s", out)
+    }
+
+    // diff, tag list, undo --list, search, log and blame share the record
+    var d diffJSON
+    out = captureOutput(t, func() { must(t, doDiff(diffOptions{Revs: []string{"ck~1"}, JSON: true})) })
+    must(t, json.Unmarshal([]byte(out), &d))
+    if d.From == nil || d.From.Subject != "first" || d.To != nil || len(d.Files) != 2 {
+        t.Fatalf("unexpected diff json: %s", out)
+    }
+    must(t, createTag("ck", "named"))
+    out = captureOutput(t, func() { must(t, doTagListJSON()) })
+    must(t, json.Unmarshal([]byte(out), &list))
+    if len(list) != 1 || len(list[0].Tags) != 1 || list[0].Tags[0] != "named" {
+        t.Fatalf("unexpected tag json: %s", out)
+    }
+    captureOutput(t, func() { must(t, doRestore("ck~1", restoreOptions{})) })
+    out = captureOutput(t, func() { must(t, doUndoListJSON(5)) })
+    must(t, json.Unmarshal([]byte(out), &list))
+    if len(list) != 1 || !strings.Contains(list[0].Subject, "restore") {
+        t.Fatalf("unexpected undo json: %s", out)
+    }
+    var hits []searchHitJSON
+    out = captureOutput(t, func() { must(t, doSearchJSON(searchOptions{S: "two"})) })
+    must(t, json.Unmarshal([]byte(out), &hits))
+    if len(hits) != 1 || hits[0].Subject != "second" || hits[0].Source != "ck" || hits[0].Present == nil || !*hits[0].Present {
+        t.Fatalf("unexpected search json: %s", out)
+    }
+    var log []fileLogJSON
+    out = captureOutput(t, func() { must(t, doFileLogJSON("ck", "j.txt", 10)) })
+    must(t, json.Unmarshal([]byte(out), &log))
+    if len(log) != 2 || log[0].Subject != "second" || len(log[0].Stats) != 1 || log[0].Stats[0].Additions != 1 {
+        t.Fatalf("unexpected log json: %s", out)
+    }
+    var bl blameJSON
+    out = captureOutput(t, func() { must(t, doBlameJSON("ck", "j.txt")) })
+    must(t, json.Unmarshal([]byte(out), &bl))
+    if len(bl.Lines) != 1 || bl.Lines[0].Text != "one" || bl.Lines[0].Sha != "" {
+        t.Fatalf("unexpected blame json: %s", out)
+    }
+}
+
+func TestCheckpointTrailers(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("t.txt", []byte("a\nb\n"), 0o644)
+    must(t, doCheckpoint("first"))
+    os.WriteFile("t.txt", []byte("a\nc\nd\n"), 0o644)
+    must(t, doCheckpoint("second"))
+    ref, err := ckRef()
+    must(t, err)
+    m := parseMeta(runGit(t, repo, "log", "-1", "--format=%B", ref))
+    if m.Kind != "manual" || m.SummarySource != "manual" || m.User != getUserID() || m.Host == "" {
+        t.Fatalf("unexpected identity trailers: %+v", m)
+    }
+    if m.Files != "1" || m.Insertions != "2" || m.Deletions != "1" {
+        t.Fatalf("unexpected file stats: files=%s +%s -%s", m.Files, m.Insertions, m.Deletions)
+    }
+    out := captureOutput(t, func() { must(t, doList(1, true)) })
+    if !strings.Contains(out, "kind=manual") || !strings.Contains(out, "files=1 +2 -1") {
+        t.Fatalf("list --meta missing new trailers:\n%s", out)
+    }
+}
+
+func TestSearchCheckpoints(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("s.txt", []byte("plain\n"), 0o644)
+    must(t, doCheckpoint("Add parser"))
+    os.WriteFile("s.txt", []byte("plain\nneedle\n"), 0o644)
+    must(t, doCheckpoint("Wire lexer"))
+    os.WriteFile("s.txt", []byte("plain\nneedle\nmore\n"), 0o644)
+    must(t, doCheckpoint("Tweak lexer"))
+    os.WriteFile("s.txt", []byte("plain\n"), 0o644)
+    must(t, doCheckpoint("Drop needle"))
+    ref, _ := ckRef()
+    wire := runGit(t, repo, "rev-parse", "--short=7", ref+"~2")
+    tweak := runGit(t, repo, "rev-parse", "--short=7", ref+"~1")
+
+    out := captureOutput(t, func() { must(t, doSearch(searchOptions{Text: "LEXER"})) })
+    if !strings.Contains(out, "Wire lexer") || !strings.Contains(out, "Tweak lexer") || strings.Contains(out, "Add parser") {
+        t.Fatalf("unexpected subject search output:\n%s", out)
+    }
+    out = captureOutput(t, func() { must(t, doSearch(searchOptions{S: "needle"})) })
+    if !strings.Contains(out, "First seen: "+wire) || !strings.Contains(out, "Last seen:  "+tweak) {
+        t.Fatalf("unexpected pickaxe span (want first %s, last %s):\n%s", wire, tweak, out)
+    }
+}
+
+func TestFileLogAndBlame(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("f.txt", []byte("one\ntwo\n"), 0o644)
+    must(t, doCheckpoint("Start f"))
+    os.WriteFile("other.txt", []byte("x\n"), 0o644)
+    must(t, doCheckpoint("Unrelated"))
+    os.WriteFile("f.txt", []byte("one\nTWO\nthree\n"), 0o644)
+    must(t, doCheckpoint("Edit f"))
+    ref, _ := ckRef()
+    start := runGit(t, repo, "rev-parse", "--short=7", ref+"~2")
+    edit := runGit(t, repo, "rev-parse", "--short=7", ref)
+
+    out := captureOutput(t, func() { must(t, doFileLog("ck", "f.txt", 50)) })
+    if !strings.Contains(out, "Start f") || !strings.Contains(out, "Edit f") || strings.Contains(out, "Unrelated") {
+        t.Fatalf("unexpected file log:\n%s", out)
+    }
+    if !strings.Contains(out, "+2 -1  f.txt") {
+        t.Fatalf("missing per-file diffstat:\n%s", out)
+    }
+
+    os.WriteFile("f.txt", []byte("one\nTWO\nthree\nfour\n"), 0o644)
+    out = captureOutput(t, func() { must(t, doBlame("ck", "f.txt")) })
+    lines := strings.Split(out, "\n")
+    if len(lines) < 4 || !strings.HasPrefix(lines[0], start) || !strings.HasPrefix(lines[1], edit) || !strings.Contains(lines[3], "(worktree)") {
+        t.Fatalf("unexpected blame:\n%s", out)
+    }
+    if !strings.Contains(lines[0], getUserID()) {
+        t.Fatalf("blame should name the user:\n%s", out)
+    }
+
+    // Lines that were already committed come from the branch history, not
+    // from the first snapshot
+    committed := withTempRepo(t)
+    must(t, os.Chdir(committed))
+    os.WriteFile("g.txt", []byte("old\n"), 0o644)
+    runGit(t, committed, "add", "g.txt")
+    runGit(t, committed, "commit", "-q", "-m", "Add g")
+    head := runGit(t, committed, "rev-parse", "--short=7", "HEAD")
+    os.WriteFile("g.txt", []byte("old\nnew\n"), 0o644)
+    must(t, doCheckpoint("Extend g"))
+    first := runGit(t, committed, "rev-parse", "--short=7", "refs/aigit/checkpoints/main")
+    out = captureOutput(t, func() { must(t, doBlame("ck", "g.txt")) })
+    lines = strings.Split(out, "\n")
+    if !strings.HasPrefix(lines[0], head) || !strings.HasPrefix(lines[1], first) || !strings.Contains(out, "Add g  (commit") {
+        t.Fatalf("unexpected blame over committed lines:\n%s", out)
+    }
+    if refs := runGit(t, committed, "for-each-ref"); strings.Contains(refs, "replace") || strings.Contains(refs, "blame") {
+        t.Fatalf("blame wrote graft refs into the repository:\n%s", refs)
+    }
+    // Paths are relative to the working directory, as with git blame
+    os.MkdirAll(filepath.Join(committed, "sub"), 0o755)
+    must(t, os.Chdir(filepath.Join(committed, "sub")))
+    out = captureOutput(t, func() { must(t, doBlame("ck", "../g.txt")) })
+    if lines = strings.Split(out, "\n"); !strings.HasPrefix(lines[0], head) {
+        t.Fatalf("unexpected blame from a subdirectory:\n%s", out)
+    }
+    must(t, os.Chdir(committed))
+}
+
+func TestBisectCheckpoints(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    states := []string{"pass 1", "pass 2", "pass 3", "fail 4", "fail 5", "fail 6"}
+    for i, s := range states {
+        os.WriteFile("b.txt", []byte(s+"\n"), 0o644)
+        must(t, doCheckpoint(fmt.Sprintf("Step %d", i+1)))
+    }
+    os.WriteFile("b.txt", []byte("local edits\n"), 0o644)
+    head := runGit(t, repo, "rev-parse", "HEAD")
+
+    must(t, doBisectStart("ck~5", "ck"))
+    out := captureOutput(t, func() { must(t, doBisectRun([]string{"grep -q pass b.txt"})) })
+    ref, _ := ckRef()
+    firstBad := runGit(t, repo, "rev-parse", "--short=7", ref+"~2")
+    if !strings.Contains(out, "First bad checkpoint: "+firstBad+"  Step 4") || !strings.Contains(out, "Aigit-Kind: manual") {
+        t.Fatalf("unexpected bisect result (want %s):\n%s", firstBad, out)
+    }
+    if b, _ := os.ReadFile("b.txt"); string(b) != "local edits\n" {
+        t.Fatalf("bisect touched the worktree: %q", b)
+    }
+    if runGit(t, repo, "rev-parse", "HEAD") != head {
+        t.Fatalf("bisect moved HEAD")
+    }
+    if wts := runGit(t, repo, "worktree", "list"); strings.Count(wts, "\n") != 0 {
+        t.Fatalf("scratch worktree left behind:\n%s", wts)
+    }
+
+    // A command killed by a signal aborts instead of marking the snapshot bad
+    if runtime.GOOS != "windows" {
+        var err error
+        captureOutput(t, func() { err = doBisectRun([]string{"kill -9 $$"}) })
+        if err == nil || !strings.Contains(err.Error(), "killed") {
+            t.Fatalf("expected killed command to abort bisect, got %v", err)
+        }
+
+        // Several arguments are run as they are, so quoting survives
+        out = captureOutput(t, func() { must(t, doBisectRun([]string{"sh", "-c", "grep -q pass b.txt"})) })
+        if !strings.Contains(out, "First bad checkpoint: "+firstBad+"  Step 4") {
+            t.Fatalf("unexpected bisect result with argv (want %s):\n%s", firstBad, out)
+        }
+    }
+}
+
+func TestRestoreStaged(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("a.txt", []byte("staged\n"), 0o644)
+    os.WriteFile("b.txt", []byte("unstaged\n"), 0o644)
+    runGit(t, repo, "add", "a.txt")
+    os.WriteFile("a.txt", []byte("staged\nplus unstaged\n"), 0o644)
+    must(t, doCheckpoint("Split index"))
+    ref, _ := ckRef()
+    sha := runGit(t, repo, "rev-parse", ref)
+    if body := runGit(t, repo, "show", "-s", "--format=%B", sha); !strings.Contains(body, "Aigit-Index: ") {
+        t.Fatalf("missing Aigit-Index trailer:\n%s", body)
+    }
+    indexBefore := runGit(t, repo, "diff", "--cached", "--name-status")
+
+    // Lose the split, then bring it back
+    runGit(t, repo, "add", "-A")
+    os.WriteFile("a.txt", []byte("other\n"), 0o644)
+    must(t, doRestore(sha, restoreOptions{Staged: true}))
+    if got := runGit(t, repo, "diff", "--cached", "--name-status"); got != indexBefore {
+        t.Fatalf("staged set not restored: got %q want %q", got, indexBefore)
+    }
+    if got := runGit(t, repo, "show", ":a.txt"); got != "staged" {
+        t.Fatalf("staged content not restored: %q", got)
+    }
+    if b, _ := os.ReadFile("a.txt"); string(b) != "staged\nplus unstaged\n" {
+        t.Fatalf("worktree content not restored: %q", b)
+    }
+
+    // Plain restore leaves the index alone
+    runGit(t, repo, "add", "-A")
+    must(t, doRestore(sha, restoreOptions{}))
+    if got := runGit(t, repo, "diff", "--cached", "--name-status"); got == indexBefore {
+        t.Fatalf("restore without --staged should not touch the index")
+    }
+}
+
+func TestIndexTreeReachable(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    runGit(t, repo, "config", "aigit.keep.recent", "1")
+    runGit(t, repo, "config", "aigit.keep.hourly", "0")
+    runGit(t, repo, "config", "aigit.keep.daily", "0")
+
+    ref, err := ckRef()
+    must(t, err)
+    br, err := currentBranch()
+    must(t, err)
+    for i := 0; i < 4; i++ {
+        os.WriteFile("a.txt", []byte(strings.Repeat("staged\n", i+1)), 0o644)
+        runGit(t, repo, "add", "a.txt")
+        os.WriteFile("a.txt", []byte("unstaged\n"), 0o644)
+        must(t, doCheckpoint("step"))
+    }
+    idx := runGit(t, repo, "log", "-1", "--format=%(trailers:key=Aigit-Index,valueonly)", ref)
+    if idx == "" { t.Fatalf("missing Aigit-Index trailer") }
+
+    // git gc must not prune the staging area
+    runGit(t, repo, "gc", "-q", "--prune=now")
+    runGit(t, repo, "cat-file", "-e", idx+"^{tree}")
+
+    // push carries it along
+    bare := filepath.Join(t.TempDir(), "remote.git")
+    runGit(t, repo, "init", "-q", "--bare", bare)
+    runGit(t, repo, "remote", "add", "origin", bare)
+    must(t, pushCheckpoints("origin"))
+    runGit(t, bare, "cat-file", "-e", idx+"^{tree}")
+    if got := runGit(t, bare, "rev-parse", userIndexRemoteRef(getUserID(), br)+"^{tree}"); got != idx {
+        t.Fatalf("remote index chain tip = %s, want %s", got, idx)
+    }
+
+    // aigit gc drops staging areas of pruned snapshots only
+    if n := runGit(t, repo, "rev-list", "--count", indexRef(br)); n != "4" {
+        t.Fatalf("expected 4 staging areas before gc, got %s", n)
+    }
+    must(t, doGC(false, false))
+    if n := runGit(t, repo, "rev-list", "--count", indexRef(br)); n != "1" {
+        t.Fatalf("expected 1 staging area after gc, got %s", n)
+    }
+    if got := runGit(t, repo, "rev-parse", indexRef(br)+"^{tree}"); got != idx {
+        t.Fatalf("gc dropped the staging area still in use")
+    }
+}
+
+func TestRestoreWithMergeState(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    for _, name := range []string{"file.txt", "other.txt", "a, b.txt"} {
+        os.WriteFile(name, []byte("base\n"), 0o644)
+    }
+    runGit(t, repo, "add", ".")
+    runGit(t, repo, "commit", "-m", "base")
+    runGit(t, repo, "checkout", "-b", "feature")
+    for _, name := range []string{"file.txt", "other.txt", "a, b.txt"} {
+        os.WriteFile(name, []byte("feature\n"), 0o644)
+    }
+    runGit(t, repo, "commit", "-am", "feature change")
+    runGit(t, repo, "checkout", "main")
+    for _, name := range []string{"file.txt", "other.txt", "a, b.txt"} {
+        os.WriteFile(name, []byte("main\n"), 0o644)
+    }
+    runGit(t, repo, "commit", "-am", "main change")
+    _ = exec.Command("git", "merge", "feature").Run()
+
+    // Resolve one file, leave the other conflicted, then checkpoint
+    os.WriteFile("other.txt", []byte("resolved\n"), 0o644)
+    runGit(t, repo, "add", "other.txt")
+    must(t, doCheckpoint("half resolved"))
+    ref, _ := ckRef()
+    sha := runGit(t, repo, "rev-parse", ref)
+    body := runGit(t, repo, "show", "-s", "--format=%B", sha)
+    if !strings.Contains(body, "Aigit-Op: merge") || !strings.Contains(body, "Aigit-Conflicts: file.txt") {
+        t.Fatalf("expected merge state trailers, got:\n%s", body)
+    }
+    // One trailer per path, so a comma in a path does not split it
+    if got := parseMeta(body).Conflicts; len(got) != 2 || got[0] != "a, b.txt" || got[1] != "file.txt" {
+        t.Fatalf("conflicts = %q", got)
+    }
+    if n := runGit(t, repo, "log", "--first-parent", "--format=%H", ref); strings.Count(n, "\n") != 0 {
+        t.Fatalf("state commit leaked into the first-parent chain:\n%s", n)
+    }
+
+    runGit(t, repo, "merge", "--abort")
+    must(t, doRestore(sha, restoreOptions{WithState: true}))
+    if _, err := os.Stat(filepath.Join(".git", "MERGE_HEAD")); err != nil {
+        t.Fatalf("MERGE_HEAD not restored: %v", err)
+    }
+    if got := runGit(t, repo, "diff", "--name-only", "--diff-filter=U"); got != "a, b.txt\nfile.txt" {
+        t.Fatalf("conflicts not restored: %q", got)
+    }
+    if got := runGit(t, repo, "show", ":other.txt"); got != "resolved" {
+        t.Fatalf("resolved entry not restored: %q", got)
+    }
+    // The merge can be finished as usual
+    os.WriteFile("file.txt", []byte("done\n"), 0o644)
+    os.WriteFile("a, b.txt", []byte("done\n"), 0o644)
+    runGit(t, repo, "add", "file.txt", "a, b.txt")
+    runGit(t, repo, "commit", "--no-edit")
+    if parents := runGit(t, repo, "log", "-1", "--format=%P"); len(strings.Fields(parents)) != 2 {
+        t.Fatalf("expected a merge commit, parents %q", parents)
+    }
+}
+
+func TestStashRoundTrip(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    os.WriteFile("a.txt", []byte("a\n"), 0o644)
+    os.WriteFile("b.txt", []byte("b\n"), 0o644)
+    runGit(t, repo, "add", ".")
+    runGit(t, repo, "commit", "-m", "base")
+
+    os.WriteFile("a.txt", []byte("a staged\n"), 0o644)
+    runGit(t, repo, "add", "a.txt")
+    os.WriteFile("b.txt", []byte("b unstaged\n"), 0o644)
+    os.WriteFile("c.txt", []byte("untracked\n"), 0o644)
+    must(t, doCheckpoint("Mixed work"))
+
+    runGit(t, repo, "reset", "--hard", "-q")
+    os.Remove("c.txt")
+    must(t, doStashFromCheckpoint("ck"))
+    if got := runGit(t, repo, "stash", "list"); !strings.Contains(got, "On main: Mixed work") {
+        t.Fatalf("unexpected stash list: %q", got)
+    }
+    runGit(t, repo, "stash", "apply", "--index")
+    if got := runGit(t, repo, "diff", "--cached", "--name-only"); got != "a.txt" {
+        t.Fatalf("staged files after apply: %q", got)
+    }
+    if got := runGit(t, repo, "diff", "--name-only"); got != "b.txt" {
+        t.Fatalf("unstaged files after apply: %q", got)
+    }
+    if b, _ := os.ReadFile("c.txt"); string(b) != "untracked\n" {
+        t.Fatalf("untracked file not restored: %q", b)
+    }
+
+    // And back: a stash with untracked files becomes a checkpoint
+    runGit(t, repo, "stash", "push", "-u", "-m", "Try other approach")
+    must(t, doCheckpointFromStash("stash@{0}"))
+    ref, _ := ckRef()
+    if subj := runGit(t, repo, "log", "-1", "--format=%s", ref); subj != "Try other approach" {
+        t.Fatalf("unexpected imported subject: %q", subj)
+    }
+    files := runGit(t, repo, "ls-tree", "-r", "--name-only", ref)
+    if !strings.Contains(files, "c.txt") {
+        t.Fatalf("untracked files missing from imported checkpoint:\n%s", files)
+    }
+    if body := runGit(t, repo, "show", "-s", "--format=%B", ref); !strings.Contains(body, "Aigit-Kind: stash") || !strings.Contains(body, "Aigit-Index: ") {
+        t.Fatalf("unexpected imported trailers:\n%s", body)
+    }
+}
+
+func TestRefNamingEdgeCases(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    // Detached HEAD: keyed on the commit, not refs/aigit/checkpoints/HEAD
+    head := runGit(t, repo, "rev-parse", "HEAD")
+    runGit(t, repo, "checkout", "-q", "--detach")
+    os.WriteFile("d.txt", []byte("detached\n"), 0o644)
+    must(t, doCheckpoint("Detached work"))
+    runGit(t, repo, "rev-parse", "--verify", "refs/aigit/checkpoints/detached-"+head)
+    if out, _ := exec.Command("git", "rev-parse", "-q", "--verify", "refs/aigit/checkpoints/HEAD").Output(); len(out) != 0 {
+        t.Fatalf("detached snapshot written to refs/aigit/checkpoints/HEAD")
+    }
+    os.Remove("d.txt")
+
+    // Unborn branch with a slash in its name
+    runGit(t, repo, "checkout", "-q", "--orphan", "feature/new")
+    br, err := currentBranch()
+    must(t, err)
+    if br != "feature/new" {
+        t.Fatalf("unborn branch: got %q", br)
+    }
+    must(t, doCheckpoint("First on orphan"))
+    runGit(t, repo, "rev-parse", "--verify", "refs/aigit/checkpoints/feature%2Fnew")
+
+    // Teammates on slash branches are listed
+    runGit(t, repo, "update-ref", remoteTrackingLiveRef("origin", "bob", "feature/new"), head)
+    users, err := listRemoteUsers("origin", "feature/new")
+    must(t, err)
+    if len(users) != 1 || users[0] != "bob" {
+        t.Fatalf("remote users on slash branch: %v", users)
+    }
+
+    // A stale chain of branch feature does not block feature/x, and tags of
+    // a and of a/b live side by side
+    runGit(t, repo, "checkout", "-q", "-b", "feature", head)
+    must(t, doCheckpoint("On feature"))
+    runGit(t, repo, "checkout", "-q", "--detach")
+    runGit(t, repo, "branch", "-q", "-D", "feature")
+    runGit(t, repo, "checkout", "-q", "-b", "feature/x")
+    os.WriteFile("x.txt", []byte("x\n"), 0o644)
+    must(t, doCheckpoint("On feature/x"))
+    runGit(t, repo, "rev-parse", "--verify", "refs/aigit/checkpoints/feature")
+    runGit(t, repo, "rev-parse", "--verify", "refs/aigit/checkpoints/feature%2Fx")
+    runGit(t, repo, "checkout", "-q", "-b", "a")
+    must(t, doCheckpoint("On a"))
+    must(t, createTag("ck", "b"))
+    runGit(t, repo, "checkout", "-q", "--detach")
+    runGit(t, repo, "branch", "-q", "-D", "a")
+    runGit(t, repo, "checkout", "-q", "-b", "a/b")
+    os.WriteFile("x.txt", []byte("a/b\n"), 0o644)
+    must(t, doCheckpoint("On a/b"))
+    must(t, createTag("ck", "wip/c"))
+    tags := branchTags("a/b")
+    if len(tags) != 1 {
+        t.Fatalf("tags of a/b: %v", tags)
+    }
+    for _, names := range tags {
+        if len(names) != 1 || names[0] != "wip/c" { t.Fatalf("tags of a/b: %v", tags) }
+    }
+    if len(branchTags("a")) != 1 {
+        t.Fatalf("tags of a: %v", branchTags("a"))
+    }
+}
+
+func TestWorktrees(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    wtDir := filepath.Join(t.TempDir(), "second")
+    runGit(t, repo, "worktree", "add", "-q", "-b", "side", wtDir)
+    os.WriteFile("main.txt", []byte("main\n"), 0o644)
+    must(t, doCheckpoint("Main work"))
+
+    must(t, os.Chdir(wtDir))
+    if name := worktreeName(); name != "second" {
+        t.Fatalf("worktree name: got %q", name)
+    }
+    os.WriteFile("side.txt", []byte("side\n"), 0o644)
+    must(t, doCheckpoint("Side work"))
+    runGit(t, wtDir, "rev-parse", "--verify", "refs/aigit/checkpoints/side")
+    body := runGit(t, wtDir, "log", "-1", "--format=%B", "refs/aigit/checkpoints/side")
+    if !strings.Contains(body, "Aigit-Worktree: second") {
+        t.Fatalf("missing worktree trailer:\n%s", body)
+    }
+    out := captureOutput(t, func() { must(t, doListWorktrees(5, false)) })
+    if !strings.Contains(out, "Main work") || !strings.Contains(out, "Side work") || !strings.Contains(out, "(second)  *") {
+        t.Fatalf("list --worktree:\n%s", out)
+    }
+
+    // Per-worktree namespace: refs and remote user id are kept apart
+    runGit(t, repo, "config", "aigit.worktreeRefs", "true")
+    os.WriteFile("side.txt", []byte("side 2\n"), 0o644)
+    must(t, doCheckpoint("Namespaced"))
+    runGit(t, wtDir, "rev-parse", "--verify", "refs/aigit/worktrees/second/checkpoints/side")
+    if got, want := remoteUserID(), getUserID()+"+second"; got != want {
+        t.Fatalf("remote user id: got %q want %q", got, want)
+    }
+    must(t, createTag("ck", "side-tag"))
+    must(t, os.Chdir(repo))
+    if ref, _ := ckRef(); ref != "refs/aigit/checkpoints/main" {
+        t.Fatalf("main worktree ref changed: %s", ref)
+    }
+    // Each worktree's tags are read from its own namespace
+    out = captureOutput(t, func() { must(t, doListWorktrees(5, false)) })
+    if !strings.Contains(out, "side-tag") {
+        t.Fatalf("list --worktree lost the namespaced tag:\n%s", out)
+    }
+}
+
+func TestSubmoduleRecurse(t *testing.T) {
+    lib := withTempRepo(t)
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    runGit(t, repo, "-c", "protocol.file.allow=always", "submodule", "add", "-q", lib, "lib")
+    runGit(t, repo, "commit", "-qm", "add lib")
+    runGit(t, repo, "config", "aigit.submodules", "recurse")
+    runGit(t, filepath.Join(repo, "lib"), "config", "user.name", "Test User")
+    runGit(t, filepath.Join(repo, "lib"), "config", "user.email", "test@example.com")
+
+    libFile := filepath.Join("lib", "init.txt")
+    orig, err := os.ReadFile(libFile)
+    must(t, err)
+    os.WriteFile(libFile, []byte("edited inside the submodule\n"), 0o644)
+    os.WriteFile(filepath.Join("lib", "staged.txt"), []byte("staged\n"), 0o644)
+    runGit(t, filepath.Join(repo, "lib"), "add", "staged.txt")
+    libIndex := runGit(t, filepath.Join(repo, "lib"), "write-tree")
+    must(t, doCheckpoint("Edit lib"))
+    // git is pointed at the submodule; the process stays where it is
+    must(t, eachSubmodule(func(p string) error {
+        if wd, _ := os.Getwd(); wd != repo { t.Fatalf("cwd moved to %s", wd) }
+        return nil
+    }))
+
+    body := runGit(t, repo, "log", "-1", "--format=%B", "refs/aigit/checkpoints/main")
+    subs, err := submoduleSnapshots(runGit(t, repo, "rev-parse", "refs/aigit/checkpoints/main"))
+    must(t, err)
+    subSha := subs["lib"]
+    if subSha == "" {
+        t.Fatalf("no submodule trailer:\n%s", body)
+    }
+    if tips := runGit(t, filepath.Join(repo, "lib"), "for-each-ref", "--format=%(objectname)", "refs/aigit/checkpoints/"); tips != subSha {
+        t.Fatalf("submodule chain tips %q, trailer %s", tips, subSha)
+    }
+    if info, err := snapshotInfo("refs/aigit/checkpoints/main", nil); err != nil || len(info.Submodules) != 1 || info.Submodules[0] != (submoduleJSON{Path: "lib", Sha: subSha}) {
+        t.Fatalf("submodules in json = %+v, %v", info.Submodules, err)
+    }
+    if idx := runGit(t, filepath.Join(repo, "lib"), "log", "-1", "--format=%(trailers:key=Aigit-Index,valueonly)", subSha); idx != libIndex {
+        t.Fatalf("submodule staging area %q, want %s", idx, libIndex)
+    }
+
+    // Restoring the superproject snapshot brings the submodule work back
+    os.WriteFile(libFile, orig, 0o644)
+    out := captureOutput(t, func() { must(t, doRestore("ck", restoreOptions{})) })
+    if b, _ := os.ReadFile(libFile); string(b) != "edited inside the submodule\n" {
+        t.Fatalf("submodule file not restored: %q\n%s", b, out)
+    }
+    if !strings.Contains(out, "lib/init.txt") {
+        t.Fatalf("restore did not list the submodule file:\n%s", out)
+    }
+    // ...and undo puts the clean submodule back
+    captureOutput(t, func() { must(t, doUndo()) })
+    if b, _ := os.ReadFile(libFile); string(b) != string(orig) {
+        t.Fatalf("undo left submodule file as %q", b)
+    }
+
+    // A submodule on a branch with a slash uses the same escaped chain as
+    // list and push do inside it
+    runGit(t, filepath.Join(repo, "lib"), "checkout", "-q", "-b", "feat/x")
+    os.WriteFile(libFile, []byte("on feat/x\n"), 0o644)
+    must(t, doCheckpoint("Edit lib on feat/x"))
+    subs, err = submoduleSnapshots(runGit(t, repo, "rev-parse", "refs/aigit/checkpoints/main"))
+    must(t, err)
+    if got := runGit(t, filepath.Join(repo, "lib"), "rev-parse", "refs/aigit/checkpoints/"+refBranch("feat/x")); got != subs["lib"] {
+        t.Fatalf("submodule chain for feat/x at %q, trailer %s", got, subs["lib"])
+    }
+}
+
+func TestScopedCheckpoint(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.MkdirAll(filepath.Join("pkg", "a"), 0o755)
+    os.MkdirAll(filepath.Join("pkg", "b"), 0o755)
+    os.WriteFile(filepath.Join("pkg", "a", "a.go"), []byte("a1\n"), 0o644)
+    os.WriteFile(filepath.Join("pkg", "b", "b.go"), []byte("b1\n"), 0o644)
+    must(t, doCheckpoint("Full"))
+
+    // Only pkg/a is taken from the worktree; pkg/b stays as in "Full"
+    os.WriteFile(filepath.Join("pkg", "a", "a.go"), []byte("a2\n"), 0o644)
+    os.WriteFile(filepath.Join("pkg", "b", "b.go"), []byte("b2\n"), 0o644)
+    must(t, os.Chdir("pkg"))
+    must(t, doCheckpoint("Just a", "a"))
+    must(t, os.Chdir(repo))
+    if got := runGit(t, repo, "show", "refs/aigit/checkpoints/main:pkg/b/b.go"); got != "b1" {
+        t.Fatalf("out-of-scope file taken from worktree: %q", got)
+    }
+    if got := runGit(t, repo, "show", "refs/aigit/checkpoints/main:pkg/a/a.go"); got != "a2" {
+        t.Fatalf("in-scope file not snapshotted: %q", got)
+    }
+    out := captureOutput(t, func() { must(t, doList(5, true)) })
+    if !strings.Contains(out, "Just a  (scope: pkg/a)") || !strings.Contains(out, "scope=pkg/a") {
+        t.Fatalf("list does not show the scope:\n%s", out)
+    }
+
+    // Restoring a scoped checkpoint leaves other paths alone
+    os.WriteFile(filepath.Join("pkg", "a", "a.go"), []byte("a3\n"), 0o644)
+    captureOutput(t, func() { must(t, doRestore("ck", restoreOptions{})) })
+    if b, _ := os.ReadFile(filepath.Join("pkg", "a", "a.go")); string(b) != "a2\n" {
+        t.Fatalf("scoped file not restored: %q", b)
+    }
+    if b, _ := os.ReadFile(filepath.Join("pkg", "b", "b.go")); string(b) != "b2\n" {
+        t.Fatalf("out-of-scope file restored: %q", b)
+    }
+
+    // Commas and spaces in a scoped path do not split it
+    os.WriteFile("a, b.txt", []byte("ab1\n"), 0o644)
+    must(t, doCheckpoint("Comma", "a, b.txt", filepath.Join("pkg", "b")))
+    body := runGit(t, repo, "log", "-1", "--format=%B", "refs/aigit/checkpoints/main")
+    if got := parseMeta(body).Scope; len(got) != 2 || got[0] != "a, b.txt" || got[1] != "pkg/b" {
+        t.Fatalf("scope = %q\n%s", got, body)
+    }
+    var list []snapshotJSON
+    out = captureOutput(t, func() { must(t, doListJSON(1)) })
+    must(t, json.Unmarshal([]byte(out), &list))
+    if len(list) != 1 || len(list[0].Scope) != 2 || list[0].Scope[0] != "a, b.txt" || list[0].Scope[1] != "pkg/b" {
+        t.Fatalf("list --json does not carry every scope path:\n%s", out)
+    }
+    os.WriteFile("a, b.txt", []byte("ab2\n"), 0o644)
+    os.WriteFile(filepath.Join("pkg", "b", "b.go"), []byte("b3\n"), 0o644)
+    os.WriteFile(filepath.Join("pkg", "a", "a.go"), []byte("a4\n"), 0o644)
+    captureOutput(t, func() { must(t, doRestore("ck", restoreOptions{})) })
+    if b, _ := os.ReadFile("a, b.txt"); string(b) != "ab1\n" {
+        t.Fatalf("path with a comma not restored: %q", b)
+    }
+    if b, _ := os.ReadFile(filepath.Join("pkg", "b", "b.go")); string(b) != "b2\n" {
+        t.Fatalf("second scoped path not restored: %q", b)
+    }
+    if b, _ := os.ReadFile(filepath.Join("pkg", "a", "a.go")); string(b) != "a4\n" {
+        t.Fatalf("out-of-scope file restored: %q", b)
+    }
+}
+
+func TestTimeAddressing(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    // Snapshots stamped 3h, 90m and 10m ago via their Aigit-When trailers
+    now := time.Now()
+    stamp := func(ref, content string, ago time.Duration) string {
+        os.WriteFile("f.txt", []byte(content), 0o644)
+        tree, err := snapshotTree()
+        must(t, err)
+        args := []string{"commit-tree", tree}
+        if parent, err := git("rev-parse", "-q", "--verify", ref); err == nil { args = append(args, "-p", parent) }
+        msg := fmt.Sprintf("%s\n\nAigit-When: %s\nAigit-Kind: manual\n", content, now.Add(-ago).UTC().Format(time.RFC3339))
+        sha, err := gitInput(msg, args...)
+        must(t, err)
+        runGit(t, repo, "update-ref", ref, sha)
+        return sha
+    }
+    old := stamp("refs/aigit/checkpoints/main", "three hours", 3*time.Hour)
+    mid := stamp("refs/aigit/live/main", "ninety minutes", 90*time.Minute)
+    stamp("refs/aigit/checkpoints/main", "ten minutes", 10*time.Minute)
+
+    for spec, want := range map[string]string{
+        "@{1h}": mid, // checkpoints and live together
+        "ck@{1h}": old,
+        "live@{20m}": mid,
+        "@{" + now.Add(-2*time.Hour).Format("2006-01-02 15:04") + "}": old,
+    } {
+        r, err := resolveRev(spec)
+        must(t, err)
+        if r.Commit != want {
+            t.Fatalf("%s: got %s want %s", spec, short(r.Commit), short(want))
+        }
+    }
+    if _, err := resolveRev("live@{yesterday}"); err == nil {
+        t.Fatalf("live@{yesterday} should find nothing")
+    }
+    if _, err := parseWhen("not a time"); err == nil {
+        t.Fatalf("garbage time accepted")
+    }
+
+    // restore --before is @{<time>}
+    captureOutput(t, func() { must(t, doRestore("@{1h}", restoreOptions{})) })
+    if b, _ := os.ReadFile("f.txt"); string(b) != "ninety minutes" {
+        t.Fatalf("restore @{1h}: got %q", b)
+    }
+
+    // git's own @{...} selectors are not times
+    os.WriteFile("g.txt", []byte("one\n"), 0o644)
+    runGit(t, repo, "add", "g.txt")
+    runGit(t, repo, "commit", "-q", "-m", "second")
+    os.WriteFile("g.txt", []byte("stashed\n"), 0o644)
+    runGit(t, repo, "stash", "-q")
+    bare := filepath.Join(t.TempDir(), "remote.git")
+    runGit(t, repo, "init", "-q", "--bare", bare)
+    runGit(t, repo, "remote", "add", "origin", bare)
+    runGit(t, repo, "push", "-q", "-u", "origin", "main")
+    runGit(t, repo, "config", "remote.pushDefault", "origin")
+    for _, spec := range []string{"HEAD@{1}", "stash@{0}", "main@{upstream}", "@{u}", "@{push}", "@{0}~1"} {
+        want := runGit(t, repo, "rev-parse", spec+"^{commit}")
+        r, err := resolveRev(spec)
+        must(t, err)
+        if r.Commit != want {
+            t.Fatalf("%s: got %s want %s", spec, short(r.Commit), short(want))
+        }
+    }
+}
+
+func TestIncrementalSnapshotTree(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+
+    same := func(label string, tree string, err error) {
+        t.Helper()
+        must(t, err)
+        fresh, err := snapshotTreeFresh()
+        must(t, err)
+        if tree != fresh {
+            t.Fatalf("%s: private index tree %s, fresh tree %s", label, short(tree), short(fresh))
+        }
+    }
+    os.MkdirAll("sub", 0o755)
+    os.WriteFile("a.txt", []byte("a\n"), 0o644)
+    os.WriteFile(filepath.Join("sub", "x"), []byte("x\n"), 0o644)
+    os.WriteFile(filepath.Join("sub", "y"), []byte("y\n"), 0o644)
+    tree, err := snapshotTree()
+    same("first full scan", tree, err)
+
+    os.WriteFile("a.txt", []byte("a2\n"), 0o644)
+    tree, err = snapshotTreeOf([]string{"a.txt"})
+    same("changed file", tree, err)
+    os.Remove(filepath.Join("sub", "x"))
+    tree, err = snapshotTreeOf([]string{"sub/x"})
+    same("deleted file", tree, err)
+    os.RemoveAll("sub")
+    tree, err = snapshotTreeOf([]string{"sub/y"})
+    same("deleted directory", tree, err)
+    tree, err = snapshotTreeOf([]string{})
+    same("nothing changed", tree, err)
+
+    // Files ignored after they were snapshotted drop out, as with a fresh index
+    os.MkdirAll("build", 0o755)
+    os.WriteFile(filepath.Join("build", "out"), []byte("o\n"), 0o644)
+    _, err = snapshotTree()
+    must(t, err)
+    os.WriteFile(".gitignore", []byte("build/\n"), 0o644)
+    tree, err = snapshotTree()
+    same("newly ignored", tree, err)
+    os.WriteFile(filepath.Join("build", "out"), []byte("o2\n"), 0o644)
+    os.WriteFile("a.txt", []byte("a3\n"), 0o644)
+    // Ignored paths are filtered up front, not recognized by git's
+    // (translated) error message, so this stays on the incremental path
+    before := gitSpawns.Load()
+    tree, err = snapshotTreeOf([]string{"build/out", "a.txt"})
+    if n := gitSpawns.Load() - before; n > 3 {
+        t.Fatalf("ignored change fell back to a full scan (%d git processes)", n)
+    }
+    same("ignored change", tree, err)
+
+    // An idle full scan reuses the last tree, but not once the exclude files
+    // or the private index changed behind its back
+    tree, err = snapshotTree()
+    same("rescan", tree, err)
+    before = gitSpawns.Load()
+    tree, err = snapshotTree()
+    if n := gitSpawns.Load() - before; n != 1 {
+        t.Fatalf("idle full scan started %d git processes", n)
+    }
+    same("idle rescan", tree, err)
+    os.MkdirAll(filepath.Join(".git", "info"), 0o755)
+    os.WriteFile(filepath.Join(".git", "info", "exclude"), []byte("a.txt\n"), 0o644)
+    tree, err = snapshotTree()
+    same("newly excluded", tree, err)
+    os.WriteFile("c.txt", []byte("c\n"), 0o644)
+    dir, err := aigitDir()
+    must(t, err)
+    _, err = gitEnv(map[string]string{"GIT_INDEX_FILE": filepath.Join(dir, "index")}, "add", "c.txt")
+    must(t, err)
+    tree, err = snapshotTree()
+    same("index written by another process", tree, err)
+
+    // The watcher's path set overflows to a full scan
+    s := newPathSet()
+    if s.take() != nil {
+        t.Fatalf("a new path set must ask for a full scan")
+    }
+    s.add("b")
+    s.add("a")
+    if got := s.take(); strings.Join(got, ",") != "a,b" {
+        t.Fatalf("take: %v", got)
+    }
+    for i := 0; i <= maxChangedPaths; i++ {
+        s.add(fmt.Sprint(i))
+    }
+    if s.take() != nil {
+        t.Fatalf("overflowing path set must ask for a full scan")
+    }
+}
+
+// --- Benchmarks ---
+//
+// Snapshot latency on a large worktree (100k files by default; set
+// AIGIT_BENCH_FILES to change it), one file edited per iteration:
+//
+//   go test -run '^$' -bench Snapshot -benchtime 20x
+
+var benchDir string
+
+func TestMain(m *testing.M) {
+    code := m.Run()
+    closeGitSessions()
+    if benchDir != "" { os.RemoveAll(benchDir) }
+    os.Exit(code)
+}
+
+// benchRepo creates the large repository once and chdirs into it.
+func benchRepo(b *testing.B) {
+    b.Helper()
+    if benchDir == "" {
+        n := 100000
+        if v, err := strconv.Atoi(os.Getenv("AIGIT_BENCH_FILES")); err == nil && v > 0 { n = v }
+        dir, err := os.MkdirTemp("", "aigit-bench-*")
+        if err != nil { b.Fatal(err) }
+        for i := 0; i < n; i++ {
+            d := filepath.Join(dir, fmt.Sprintf("d%03d", i/100))
+            if i%100 == 0 {
+                if err := os.MkdirAll(d, 0o755); err != nil { b.Fatal(err) }
+            }
+            if err := os.WriteFile(filepath.Join(d, fmt.Sprintf("f%02d.txt", i%100)), []byte(fmt.Sprintf("file %d\n", i)), 0o644); err != nil { b.Fatal(err) }
+        }
+        for _, args := range [][]string{{"init", "-q"}, {"config", "user.email", "bench@example.com"}, {"config", "user.name", "Bench"}} {
+            if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil { b.Fatalf("%v: %s", err, out) }
+        }
+        benchDir = dir
+    }
+    prev, _ := os.Getwd()
+    if err := os.Chdir(benchDir); err != nil { b.Fatal(err) }
+    b.Cleanup(func() { os.Chdir(prev) })
+}
+
+func benchSnapshot(b *testing.B, snap func() (string, error)) {
+    benchRepo(b)
+    if _, err := snapshotTree(); err != nil { b.Fatal(err) } // warm the private index
+    edited := filepath.Join("d000", "f00.txt")
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if err := os.WriteFile(edited, []byte(fmt.Sprintf("edit %d\n", i)), 0o644); err != nil { b.Fatal(err) }
+        if _, err := snap(); err != nil { b.Fatal(err) }
+    }
+}
+
+// Before: a throwaway index, so every file is hashed again.
+func BenchmarkSnapshotFreshIndex(b *testing.B) {
+    benchSnapshot(b, snapshotTreeFresh)
+}
+
+// Private index, full rescan (manual checkpoints, watcher safety net).
+func BenchmarkSnapshotPrivateIndex(b *testing.B) {
+    benchSnapshot(b, snapshotTree)
+}
+
+// Private index, only the paths the watcher reported.
+func BenchmarkSnapshotChangedPaths(b *testing.B) {
+    benchSnapshot(b, func() (string, error) { return snapshotTreeOf([]string{"d000/f00.txt"}) })
+}
+
+func TestSkipNoopSnapshots(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+
+    os.WriteFile("a.txt", []byte("one\n"), 0o644)
+    must(t, doCheckpoint("One"))
+    tip := runGit(t, repo, "rev-parse", "refs/aigit/checkpoints/main")
+    out := captureOutput(t, func() { must(t, doCheckpoint("Again")) })
+    if got := runGit(t, repo, "rev-parse", "refs/aigit/checkpoints/main"); got != tip {
+        t.Fatalf("identical checkpoint was written")
+    }
+    if !strings.Contains(out, "Nothing changed since checkpoint "+short(tip)) {
+        t.Fatalf("no-op checkpoint not reported:\n%s", out)
+    }
+
+    // The watcher compares against the live tip, not HEAD
+    captureOutput(t, func() { must(t, maybeCheckpoint("off", "")) })
+    live := runGit(t, repo, "rev-parse", "refs/aigit/live/main")
+    os.WriteFile("a.txt", []byte("one\n"), 0o644) // same content, new mtime
+    if changed, err := workingTreeChanged(); err != nil || changed {
+        t.Fatalf("rewrite with same content counted as a change (%v)", err)
+    }
+    captureOutput(t, func() { must(t, maybeCheckpoint("off", "")) })
+    if got := runGit(t, repo, "rev-parse", "refs/aigit/live/main"); got != live {
+        t.Fatalf("no-op live snapshot was written")
+    }
+
+    // Files that match what auto-apply brought in are not echoed back
+    os.WriteFile("a.txt", []byte("from a teammate\n"), 0o644)
+    tree, err := snapshotTree()
+    must(t, err)
+    appliedTree = tree
+    defer func() { appliedTree = "" }()
+    if changed, _ := workingTreeChanged(); changed {
+        t.Fatalf("auto-applied files counted as a local change")
+    }
+
+    // Undo entries are kept even when nothing changed in between
+    _, err = saveUndo("first")
+    must(t, err)
+    _, err = saveUndo("second")
+    must(t, err)
+    if n := runGit(t, repo, "rev-list", "--count", "refs/aigit/undo/main"); n != "2" {
+        t.Fatalf("undo entries: %s", n)
+    }
+}
+
+func TestConcurrentSnapshotWrites(t *testing.T) {
+    const writers, rounds = 4, 8
+    ref := "refs/aigit/checkpoints/main"
+    if id := os.Getenv("AIGIT_STRESS_WRITER"); id != "" {
+        // Child process: write snapshots as fast as possible
+        must(t, os.Chdir(os.Getenv("AIGIT_STRESS_REPO")))
+        for j := 0; j < rounds; j++ {
+            os.WriteFile(fmt.Sprintf("w%s-%d.txt", id, j), []byte(id+"\n"), 0o644)
+            sha, err := writeSnapshotToRef("writer "+id, ref, snapshotOptions{Kind: "manual", SummarySource: "manual"})
+            if errors.Is(err, errNoChanges) { continue }
+            must(t, err)
+            fmt.Printf("wrote:%s\n", sha)
+        }
+        return
+    }
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+
+    // Writers in other processes and in this one at the same time
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var wrote []string
+    errs := make(chan error, 2*writers)
+    for i := 0; i < writers; i++ {
+        wg.Add(2)
+        go func(id string) {
+            defer wg.Done()
+            cmd := exec.Command(os.Args[0], "-test.run=^TestConcurrentSnapshotWrites$")
+            cmd.Env = append(os.Environ(), "AIGIT_STRESS_WRITER="+id, "AIGIT_STRESS_REPO="+repo)
+            out, err := cmd.CombinedOutput()
+            if err != nil {
+                errs <- fmt.Errorf("writer %s: %v\n%s", id, err, out)
+                return
+            }
+            mu.Lock()
+            defer mu.Unlock()
+            for _, line := range strings.Split(string(out), "\n") {
+                if sha, ok := strings.CutPrefix(line, "wrote:"); ok { wrote = append(wrote, sha) }
+            }
+        }(fmt.Sprint(i))
+        go func(id string) {
+            defer wg.Done()
+            for j := 0; j < rounds; j++ {
+                os.WriteFile(fmt.Sprintf("w%s-%d.txt", id, j), []byte(id+"\n"), 0o644)
+                sha, err := writeSnapshotToRef("writer "+id, ref, snapshotOptions{Kind: "manual", SummarySource: "manual"})
+                if errors.Is(err, errNoChanges) { continue }
+                if err != nil {
+                    errs <- fmt.Errorf("writer %s: %w", id, err)
+                    return
+                }
+                mu.Lock()
+                wrote = append(wrote, sha)
+                mu.Unlock()
+            }
+        }(fmt.Sprintf("g%d", i))
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+
+    // No snapshot was lost and the chain holds the final state of every writer
+    tip := runGit(t, repo, "rev-parse", ref)
+    for _, sha := range wrote {
+        if _, err := git("merge-base", "--is-ancestor", sha, tip); err != nil {
+            t.Fatalf("snapshot %s is not on the chain", short(sha))
+        }
+    }
+    if n := runGit(t, repo, "rev-list", "--count", ref); n != strconv.Itoa(len(wrote)) {
+        t.Fatalf("chain has %s commits, writers reported %d", n, len(wrote))
+    }
+    files := runGit(t, repo, "ls-tree", "--name-only", tip)
+    for i := 0; i < writers; i++ {
+        for _, id := range []string{fmt.Sprint(i), fmt.Sprintf("g%d", i)} {
+            if name := fmt.Sprintf("w%s-%d.txt", id, rounds-1); !strings.Contains(files, name) {
+                t.Fatalf("tip misses %s", name)
+            }
+        }
+    }
+    dir, _ := aigitDir()
+    if _, err := os.Stat(filepath.Join(dir, "snapshot.lock")); err == nil {
+        t.Fatalf("snapshot lock left behind")
+    }
+}
+
+func TestSnapshotCASRetry(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+
+    ref := "refs/aigit/checkpoints/main"
+    commit := func(msg, parent string) string {
+        args := []string{"commit-tree", emptyTree}
+        if parent != "" { args = append(args, "-p", parent) }
+        sha, err := gitInput(msg+"\n", args...)
+        must(t, err)
+        return sha
+    }
+    base := commit("base", "")
+    runGit(t, repo, "update-ref", ref, base)
+
+    // Another writer moves the tip between our read and our update-ref
+    var theirs string
+    calls := 0
+    sha, err := updateChain(ref, base, "ours", func(parent string) (string, error) {
+        calls++
+        if calls == 1 {
+            theirs = commit("theirs", base)
+            runGit(t, repo, "update-ref", ref, theirs)
+        }
+        return commit("ours", parent), nil
+    })
+    must(t, err)
+    if calls != 2 {
+        t.Fatalf("build called %d times", calls)
+    }
+    if got := runGit(t, repo, "rev-parse", sha+"^"); got != theirs {
+        t.Fatalf("snapshot not re-parented onto the new tip")
+    }
+    if got := runGit(t, repo, "rev-parse", ref); got != sha {
+        t.Fatalf("tip is %s, want %s", short(got), short(sha))
+    }
+
+    // A lock left by a dead process is taken over
+    dir, err := aigitDir()
+    must(t, err)
+    lock := filepath.Join(dir, "snapshot.lock")
+    os.WriteFile(lock, []byte("999999999\n"), 0o644)
+    unlock, err := lockRepo()
+    must(t, err)
+    unlock()
+    if _, err := os.Stat(lock); err == nil {
+        t.Fatalf("lock not released")
+    }
+
+    // An old lock is only abandoned by age when its pid cannot be checked
+    old := time.Now().Add(-2 * lockStale)
+    for content, want := range map[string]bool{fmt.Sprintf("%d 1\n", os.Getpid()): false, "999999999 1\n": true, "": true} {
+        os.WriteFile(lock, []byte(content), 0o644)
+        os.Chtimes(lock, old, old)
+        fi, err := os.Stat(lock)
+        must(t, err)
+        if got := lockAbandoned([]byte(content), fi); got != want {
+            t.Fatalf("lockAbandoned(%q) = %v, want %v", content, got, want)
+        }
+    }
+    os.Remove(lock)
+
+    // Releasing leaves a lock that is no longer ours alone
+    unlock, err = lockRepo()
+    must(t, err)
+    os.WriteFile(lock, []byte("1 2\n"), 0o644)
+    unlock()
+    if b, err := os.ReadFile(lock); err != nil || string(b) != "1 2\n" {
+        t.Fatalf("release removed another process's lock: %q, %v", b, err)
+    }
+    os.Remove(lock)
+}
+
+func TestGitSpawnsPerTick(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    bare := filepath.Join(t.TempDir(), "remote.git")
+    runGit(t, repo, "init", "-q", "--bare", bare)
+    runGit(t, repo, "remote", "add", "origin", bare)
+
+    appliedTree, suppressSnapshotsUntil = "", time.Time{}
+    defer func() { appliedTree = "" }()
+
+    // Three teammates whose live snapshots are already applied here
+    os.WriteFile("a.txt", []byte("shared\n"), 0o644)
+    captureOutput(t, func() { must(t, maybeCheckpoint("off", "")) })
+    live := runGit(t, repo, "rev-parse", "refs/aigit/live/main")
+    for _, u := range []string{"alice", "bob", "carol"} {
+        runGit(t, bare, "update-ref", "refs/aigit/users/"+u+"/live/main", live)
+    }
+    captureOutput(t, func() { must(t, maybePullAndAutoApply()) })
+    suppressSnapshotsUntil = time.Time{}
+    fsChanges = newPathSet()
+    defer func() { fsChanges = nil }()
+
+    tick := func() int64 {
+        before := gitSpawns.Load()
+        captureOutput(t, func() {
+            must(t, maybePullAndAutoApply())
+            fsChanges.markAll()
+            must(t, maybeCheckpoint("off", ""))
+        })
+        return gitSpawns.Load() - before
+    }
+    tick()
+    n := tick()
+    // The same tick with every helper starting its own git process
+    plumbingOff = true
+    before := tick()
+    plumbingOff = false
+    t.Logf("git processes per idle tick: %d, %d without the plumbing session", n, before)
+    if n*10 > before {
+        t.Fatalf("idle tick started %d git processes, not an order of magnitude fewer than %d", n, before)
+    }
+    if got := runGit(t, repo, "rev-parse", "refs/aigit/live/main"); got != live {
+        t.Fatalf("idle tick wrote a snapshot")
+    }
+}
+
+func TestPlumbingCaches(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    must(t, os.Chdir(repo))
+
+    // Config changes by other processes are picked up, even at the same size
+    runGit(t, repo, "config", "aigit.user", "alice")
+    if got := getGitConfig("aigit.user"); got != "alice" {
+        t.Fatalf("aigit.user = %q", got)
+    }
+    runGit(t, repo, "config", "aigit.user", "bobby")
+    if got := getGitConfig("AIGIT.User"); got != "bobby" {
+        t.Fatalf("stale config: aigit.user = %q", got)
+    }
+    runGit(t, repo, "remote", "add", "upstream", repo)
+    if !hasRemote("upstream") || hasRemote("origin") {
+        t.Fatalf("hasRemote does not follow config changes")
+    }
+
+    // Branch switches and ref updates are seen without restarting
+    head := runGit(t, repo, "rev-parse", "HEAD")
+    if got, err := revParse("HEAD"); err != nil || got != head {
+        t.Fatalf("revParse(HEAD) = %q, %v", got, err)
+    }
+    runGit(t, repo, "checkout", "-q", "-b", "feature")
+    if br, _ := currentBranch(); br != "feature" {
+        t.Fatalf("currentBranch = %q after checkout", br)
+    }
+    os.WriteFile("b.txt", []byte("b\n"), 0o644)
+    runGit(t, repo, "add", "b.txt")
+    runGit(t, repo, "commit", "-q", "-m", "b")
+    next := runGit(t, repo, "rev-parse", "HEAD")
+    if got, _ := revParse("refs/heads/feature^{commit}"); got != next {
+        t.Fatalf("revParse did not see the new commit: %q", got)
+    }
+    tree, body, err := readCommit("HEAD")
+    must(t, err)
+    if tree != runGit(t, repo, "rev-parse", "HEAD^{tree}") || body != "b" {
+        t.Fatalf("readCommit = %q, %q", tree, body)
+    }
+    if _, err := revParse("refs/heads/missing"); err == nil {
+        t.Fatalf("missing ref resolved")
+    }
+    runGit(t, repo, "checkout", "-q", "--detach")
+    if br, _ := currentBranch(); br != detachedPrefix+next {
+        t.Fatalf("currentBranch = %q on a detached HEAD", br)
+    }
+
+    // Ref files are read like for-each-ref reads them: packed refs, with
+    // loose ones taking precedence
+    prefix := "refs/remotes/origin/aigit/users/"
+    runGit(t, repo, "update-ref", prefix+"alice/live/main", next)
+    runGit(t, repo, "update-ref", prefix+"bob/live/feat%2Fx", next)
+    runGit(t, repo, "pack-refs", "--all")
+    runGit(t, repo, "update-ref", prefix+"alice/live/main", next+"~1")
+    runGit(t, repo, "update-ref", prefix+"carol/live/main", next)
+    tips, ok := readRefFiles(prefix)
+    if !ok {
+        t.Fatalf("ref files not readable")
+    }
+    want := map[string]string{}
+    for _, line := range strings.Split(runGit(t, repo, "for-each-ref", "--format=%(objectname) %(refname)", prefix), "\n") {
+        sha, ref, _ := strings.Cut(line, " ")
+        want[ref] = sha
+    }
+    if fmt.Sprint(tips) != fmt.Sprint(want) {
+        t.Fatalf("ref files %v, for-each-ref %v", tips, want)
+    }
+}
+
+func TestLiveApplyMerge(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    write := func(dir string, files map[string]string) {
+        for name, content := range files {
+            p := filepath.Join(dir, name)
+            if content == "" {
+                os.Remove(p)
+            } else {
+                os.WriteFile(p, []byte(content), 0o644)
+            }
+        }
+    }
+    write(repo, map[string]string{"a.txt": "1\n2\n3\n4\n5\n", "b.txt": "b\n", "c.txt": "c\n", "d.txt": "d\n"})
+    runGit(t, repo, "add", ".")
+    runGit(t, repo, "commit", "-q", "-m", "files")
+    bob := filepath.Join(t.TempDir(), "bob")
+    runGit(t, repo, "clone", "-q", repo, bob)
+    runGit(t, bob, "config", "user.email", "bob@example.com")
+    // bobLive snapshots bob's clone and fetches it as a teammate's live ref
+    bobLive := func(files map[string]string) string {
+        write(bob, files)
+        must(t, os.Chdir(bob))
+        sha, err := writeSnapshotToRef("bob", "refs/aigit/live/main", snapshotOptions{Kind: "live"})
+        must(t, err)
+        must(t, os.Chdir(repo))
+        runGit(t, repo, "fetch", "-q", bob, "+refs/aigit/live/main:refs/remotes/origin/aigit/users/bob/live/main")
+        return sha
+    }
+    appliedTree = ""
+    defer func() { appliedTree = "" }()
+
+    // First apply merges against the commit bob started from
+    t1 := bobLive(map[string]string{"a.txt": "1 bob\n2\n3\n4\n5\n", "b.txt": "b bob\n", "c.txt": "c bob\n", "d.txt": "", "e.txt": "e\n"})
+    must(t, os.Chdir(repo))
+    write(repo, map[string]string{"a.txt": "1\n2\n3\n4\n5 me\n", "c.txt": "c me\n", "f.txt": "mine\n"})
+    out := captureOutput(t, func() { must(t, applyRemoteLive("origin", "bob", t1, restoreOptions{})) })
+    check := func(name, want string) {
+        t.Helper()
+        got, err := os.ReadFile(filepath.Join(repo, name))
+        if want == "" {
+            if err == nil { t.Fatalf("%s should be gone", name) }
+            return
+        }
+        if string(got) != want { t.Fatalf("%s = %q, want %q", name, got, want) }
+    }
+    check("a.txt", "1 bob\n2\n3\n4\n5 me\n")
+    check("b.txt", "b bob\n")
+    check("c.txt", "c me\n")
+    check("d.txt", "")
+    check("e.txt", "e\n")
+    check("f.txt", "mine\n")
+    if !strings.Contains(out, "Kept your side") || !strings.Contains(out, "c.txt") {
+        t.Fatalf("conflict not reported:\n%s", out)
+    }
+
+    // Later applies merge only what changed since the last one
+    runGit(t, repo, "config", "aigit.applyConflict", "markers")
+    write(repo, map[string]string{"b.txt": "b bob\nb me\n"})
+    t2 := bobLive(map[string]string{"c.txt": "c bob 2\n", "e.txt": "e 2\n"})
+    captureOutput(t, func() { must(t, applyRemoteLive("origin", "bob", t2, restoreOptions{})) })
+    check("b.txt", "b bob\nb me\n")
+    check("e.txt", "e 2\n")
+    if got, _ := os.ReadFile(filepath.Join(repo, "c.txt")); !strings.Contains(string(got), "<<<<<<< yours") || !strings.Contains(string(got), ">>>>>>> origin/bob") {
+        t.Fatalf("no conflict markers in c.txt:\n%s", got)
+    }
+
+    runGit(t, repo, "config", "aigit.applyConflict", "theirs")
+    write(repo, map[string]string{"c.txt": "c me\n"})
+    t3 := bobLive(map[string]string{"c.txt": "c bob 3\n"})
+    captureOutput(t, func() { must(t, applyRemoteLive("origin", "bob", t3, restoreOptions{})) })
+    check("c.txt", "c bob 3\n")
+    if last, _ := lastApplied("origin", "bob", "main"); last != t3 {
+        t.Fatalf("last applied = %s, want %s", last, t3)
+    }
+    // The merge is undoable like any apply
+    captureOutput(t, func() { must(t, doUndo()) })
+    check("c.txt", "c me\n")
+}
+
+func TestLiveApplyMissingBase(t *testing.T) {
+    repo := withTempRepo(t)
+    defer chdir(t, repo)()
+    t.Setenv("AIGIT_DISABLE_AUTOSTART", "1")
+    os.WriteFile(filepath.Join(repo, "a.txt"), []byte("a\n"), 0o644)
+    os.WriteFile(filepath.Join(repo, "b.txt"), []byte("b\n"), 0o644)
+    runGit(t, repo, "add", ".")
+    runGit(t, repo, "commit", "-q", "-m", "files")
+    bob := filepath.Join(t.TempDir(), "bob")
+    runGit(t, repo, "clone", "-q", repo, bob)
+    runGit(t, bob, "config", "user.email", "bob@example.com")
+    // bob works on a commit that was never pushed, so its Aigit-Base is unknown here
+    os.WriteFile(filepath.Join(bob, "a.txt"), []byte("a bob\n"), 0o644)
+    runGit(t, bob, "commit", "-q", "-am", "unpushed")
+    os.WriteFile(filepath.Join(bob, "c.txt"), []byte("c bob\n"), 0o644)
+    must(t, os.Chdir(bob))
+    sha, err := writeSnapshotToRef("bob", "refs/aigit/live/main", snapshotOptions{Kind: "live"})
+    must(t, err)
+    must(t, os.Chdir(repo))
+    runGit(t, repo, "fetch", "-q", bob, "+refs/aigit/live/main:refs/remotes/origin/aigit/users/bob/live/main")
+    body := runGit(t, repo, "show", "-s", "--format=%B", sha)
+    if _, err := revParse(parseMeta(body).Base + "^{commit}"); err == nil {
+        t.Fatalf("base commit should be missing here")
+    }
+    appliedTree = ""
+    defer func() { appliedTree = "" }()
+
+    // The local live ref already holds an edit of b.txt
+    os.WriteFile(filepath.Join(repo, "b.txt"), []byte("b me\n"), 0o644)
+    _, err = writeSnapshotToRef("", liveLocalRef("main"), snapshotOptions{Kind: "live"})
+    must(t, err)
+    captureOutput(t, func() { must(t, applyRemoteLive("origin", "bob", sha, restoreOptions{})) })
+    for name, want := range map[string]string{"a.txt": "a bob\n", "b.txt": "b me\n", "c.txt": "c bob\n"} {
+        if got, _ := os.ReadFile(filepath.Join(repo, name)); string(got) != want {
+            t.Fatalf("%s = %q, want %q", name, got, want)
+        }
+    }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// ---- aigit bisect ----
+//
+// Bisects the first-parent chain between two snapshots. Each candidate is
+// checked out into a scratch worktree, so the user's worktree and HEAD are
+// never touched while the command runs.
+
+// bisectState is persisted between `bisect start` and `bisect run`.
+type bisectState struct {
+    Good       string   `json:"good"`
+    Bad        string   `json:"bad"`
+    Candidates []string `json:"candidates"` // oldest first, ends with Bad
+}
+
+func bisectPath() (string, error) {
+    dir, err := aigitDir()
+    if err != nil { return "", err }
+    return filepath.Join(dir, "bisect.json"), nil
+}
+
+func loadBisect() (*bisectState, error) {
+    p, err := bisectPath()
+    if err != nil { return nil, err }
+    b, err := os.ReadFile(p)
+    if err != nil { return nil, errors.New("no bisect in progress (run: aigit bisect start <good> <bad>)") }
+    var st bisectState
+    if err := json.Unmarshal(b, &st); err != nil { return nil, fmt.Errorf("corrupt bisect state: %w", err) }
+    return &st, nil
+}
+
+func doBisectStart(goodSpec, badSpec string) error {
+    good, err := resolveRev(goodSpec)
+    if err != nil { return err }
+    bad, err := resolveRev(badSpec)
+    if err != nil { return err }
+    if good.Worktree || bad.Worktree { return errors.New("bisect needs two snapshots; checkpoint the worktree first") }
+    if good.Commit == bad.Commit || !isAncestor(good.Commit, bad.Commit) {
+        return fmt.Errorf("%s is not an earlier snapshot on the same chain as %s", goodSpec, badSpec)
+    }
+    out, err := git("rev-list", "--first-parent", "--reverse", good.Commit+".."+bad.Commit)
+    if err != nil { return err }
+    st := bisectState{Good: good.Commit, Bad: bad.Commit, Candidates: strings.Fields(out)}
+    p, err := bisectPath()
+    if err != nil { return err }
+    b, _ := json.MarshalIndent(st, "", "  ")
+    if err := os.WriteFile(p, b, 0o644); err != nil { return err }
+    fmt.Printf("Bisecting %d snapshots between %s (good) and %s (bad), about %d steps.\n", len(st.Candidates), short(good.Commit), short(bad.Commit), bisectSteps(len(st.Candidates)))
+    fmt.Println("Next: aigit bisect run <cmd>")
+    return nil
+}
+
+func bisectSteps(n int) int {
+    steps := 0
+    for n > 1 { n = (n + 1) / 2; steps++ }
+    return steps
+}
+
+func doBisectReset() error {
+    p, err := bisectPath()
+    if err != nil { return err }
+    if err := os.Remove(p); err != nil && !os.IsNotExist(err) { return err }
+    fmt.Println("Bisect state cleared.")
+    return nil
+}
+
+// doBisectRun tests candidates with argv until the first bad snapshot is
+// found. Exit codes follow git bisect run: 0 good, 125 skip, 1-127 bad,
+// anything else (including being killed by a signal) aborts.
+func doBisectRun(argv []string) error {
+    if len(argv) == 0 || strings.TrimSpace(argv[0]) == "" { return errors.New("usage: aigit bisect run <cmd> [<args>...]") }
+    command := strings.Join(argv, " ")
+    st, err := loadBisect()
+    if err != nil { return err }
+    scratch, err := os.MkdirTemp("", "aigit-bisect-")
+    if err != nil { return err }
+    defer os.RemoveAll(scratch)
+    dir := filepath.Join(scratch, "wt")
+    if _, err := git("worktree", "add", "--detach", "--force", dir, st.Good); err != nil { return err }
+    defer func() {
+        git("worktree", "remove", "--force", dir)
+        git("worktree", "prune")
+    }()
+
+    // lo is the newest known-good index (-1 = Good), hi the oldest known-bad
+    lo, hi := -1, len(st.Candidates)-1
+    skipped := map[int]bool{}
+    for hi-lo > 1 {
+        mid := pickBisectProbe(lo, hi, skipped)
+        if mid < 0 { break }
+        sha := st.Candidates[mid]
+        subj, _ := git("log", "-1", "--format=%s", sha)
+        fmt.Printf("Testing %s  (%s)  [%d left, ~%d steps]\n", short(sha), subj, hi-lo-1, bisectSteps(hi-lo-1))
+        if _, err := git("-C", dir, "checkout", "-q", "--force", "--detach", sha); err != nil { return err }
+        if _, err := git("-C", dir, "clean", "-fdq"); err != nil { return err }
+        code, err := runBisectCommand(dir, argv)
+        if err != nil { return err }
+        switch {
+        case code == 0:
+            fmt.Printf("  %s is good\n", short(sha))
+            lo = mid
+        case code == 125:
+            fmt.Printf("  %s skipped\n", short(sha))
+            skipped[mid] = true
+        case code < 128:
+            fmt.Printf("  %s is bad (exit %d)\n", short(sha), code)
+            hi = mid
+        default:
+            return fmt.Errorf("bisect run aborted: %q exited with %d at %s", command, code, short(sha))
+        }
+    }
+    fmt.Println("")
+    if hi-lo > 1 {
+        fmt.Println("Could not narrow further; the first bad snapshot is one of:")
+        for i := lo + 1; i <= hi; i++ {
+            subj, _ := git("log", "-1", "--format=%s", st.Candidates[i])
+            fmt.Printf("  %s  %s\n", short(st.Candidates[i]), subj)
+        }
+        return nil
+    }
+    return printFirstBad(st.Candidates[hi])
+}
+
+// pickBisectProbe returns the untested index nearest the middle of (lo, hi),
+// or -1 when every remaining candidate was skipped.
+func pickBisectProbe(lo, hi int, skipped map[int]bool) int {
+    mid := (lo + hi) / 2
+    for d := 0; mid-d > lo || mid+d < hi; d++ {
+        if i := mid - d; i > lo && !skipped[i] { return i }
+        if i := mid + d; i < hi && !skipped[i] { return i }
+    }
+    return -1
+}
+
+// runBisectCommand runs argv in dir and returns its exit code. A single
+// argument is a command line for the shell; several are run as they are,
+// like git bisect run does. A command killed by a signal has no exit code
+// and is an error.
+func runBisectCommand(dir string, argv []string) (int, error) {
+    command := strings.Join(argv, " ")
+    cmd := shellCommand(argv[0])
+    if len(argv) > 1 { cmd = exec.Command(argv[0], argv[1:]...) }
+    cmd.Dir = dir
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    cmd.Env = append(os.Environ(), "AIGIT_DISABLE_AUTOSTART=1")
+    err := cmd.Run()
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+        if code := exitErr.ExitCode(); code >= 0 { return code, nil }
+        return 0, fmt.Errorf("bisect run aborted: %q was killed (%v)", command, exitErr)
+    }
+    if err != nil { return 0, err }
+    return 0, nil
+}
+
+func printFirstBad(sha string) error {
+    body, err := git("show", "-s", "--format=%s%x1f%B", sha)
+    if err != nil { return err }
+    parts := strings.SplitN(body, "\x1f", 2)
+    fmt.Printf("First bad checkpoint: %s  %s\n", short(sha), parts[0])
+    if len(parts) < 2 { return nil }
+    trailers := parseMeta(parts[1]).Trailers
+    keys := make([]string, 0, len(trailers))
+    for k := range trailers { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fmt.Printf("  %s: %s\n", k, trailers[k])
+    }
+    logLine("Bisect: first bad %s  (%s)", short(sha), parts[0])
+    return nil
+}
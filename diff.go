@@ -0,0 +1,77 @@
+package main
+
+import (
+    "errors"
+    "strings"
+)
+
+// ---- aigit diff ----
+
+type diffOptions struct {
+    Stat     bool
+    NameOnly bool
+    JSON     bool
+    Revs     []string
+    Paths    []string
+}
+
+// parseDiffArgs accepts flags anywhere before "--" so `aigit diff live~3 --stat` works.
+func parseDiffArgs(args []string) (diffOptions, error) {
+    var opts diffOptions
+    for i := 0; i < len(args); i++ {
+        a := args[i]
+        switch a {
+        case "--":
+            opts.Paths = append(opts.Paths, args[i+1:]...)
+            i = len(args)
+        case "--stat", "-stat":
+            opts.Stat = true
+        case "--name-only", "-name-only":
+            opts.NameOnly = true
+        case "--json", "-json":
+            opts.JSON = true
+        default:
+            if strings.HasPrefix(a, "-") { return opts, errors.New("usage: aigit diff [<a>] [<b>] [--stat|--name-only|--json] [-- paths]") }
+            opts.Revs = append(opts.Revs, a)
+        }
+    }
+    if len(opts.Revs) > 2 { return opts, errors.New("usage: aigit diff [<a>] [<b>] [--stat|--name-only|--json] [-- paths]") }
+    return opts, nil
+}
+
+// diffRevs resolves the two sides of a diff. With no revisions it is the
+// latest checkpoint against the worktree; with one, that revision against
+// the worktree.
+func diffRevs(opts diffOptions) (rev, rev, error) {
+    var a, b rev
+    var err error
+    if len(opts.Revs) > 0 {
+        a, err = resolveRev(opts.Revs[0])
+    } else {
+        a, err = latestSnapshot()
+    }
+    if err != nil { return a, b, err }
+    if len(opts.Revs) > 1 {
+        b, err = resolveRev(opts.Revs[1])
+    } else {
+        b = rev{Spec: "worktree", Worktree: true}
+    }
+    return a, b, err
+}
+
+// doDiff compares two snapshots (see diffRevs).
+func doDiff(opts diffOptions) error {
+    if opts.JSON { return doDiffJSON(opts) }
+    a, b, err := diffRevs(opts)
+    if err != nil { return err }
+    from, err := a.treeish()
+    if err != nil { return err }
+    to, err := b.treeish()
+    if err != nil { return err }
+    args := []string{"--no-pager", "diff"}
+    if opts.Stat { args = append(args, "--stat") }
+    if opts.NameOnly { args = append(args, "--name-only") }
+    args = append(args, from, to, "--")
+    args = append(args, opts.Paths...)
+    return runStream("git", args...)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Retention policy / garbage collection for snapshot chains ----
+//
+// Every settle-triggered snapshot adds a commit to refs/aigit/live/<branch>.
+// gc thins a chain to the snapshots the policy retains and rewrites the
+// parent links so dropped commits become unreachable:
+//
+//   aigit.keep.recent   newest N snapshots (default 50)
+//   aigit.keep.hourly   newest snapshot of each of the last N hours with activity (default 24)
+//   aigit.keep.daily    newest snapshot of each of the last N days with activity (default 30)
+
+type keepPolicy struct {
+    Recent, Hourly, Daily int
+}
+
+func loadKeepPolicy() keepPolicy {
+    num := func(key string, def int) int {
+        if n, err := strconv.Atoi(strings.TrimSpace(getGitConfig(key))); err == nil && n >= 0 { return n }
+        return def
+    }
+    return keepPolicy{
+        Recent: num("aigit.keep.recent", 50),
+        Hourly: num("aigit.keep.hourly", 24),
+        Daily:  num("aigit.keep.daily", 30),
+    }
+}
+
+// chainCommit is a snapshot commit with everything needed to recreate it.
+type chainCommit struct {
+    Sha, Tree, Message     string
+    Parents                []string
+    AuthorName, AuthorMail string
+    AuthorDate             string
+    CommitName, CommitMail string
+    CommitDate             string
+    Time                   time.Time
+}
+
+// readChain returns the first-parent chain of ref, newest first.
+func readChain(ref string) ([]chainCommit, error) {
+    out, err := git("log", "--first-parent", "--format=%H%x1f%P%x1f%T%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%ct%x1f%B%x1e", ref)
+    if err != nil { return nil, err }
+    var chain []chainCommit
+    for _, rec := range strings.Split(out, "\x1e") {
+        rec = strings.TrimLeft(rec, "\n")
+        if rec == "" { continue }
+        f := strings.SplitN(rec, "\x1f", 11)
+        if len(f) < 11 { continue }
+        ct, _ := strconv.ParseInt(f[9], 10, 64)
+        chain = append(chain, chainCommit{
+            Sha: f[0], Parents: strings.Fields(f[1]), Tree: f[2],
+            AuthorName: f[3], AuthorMail: f[4], AuthorDate: f[5],
+            CommitName: f[6], CommitMail: f[7], CommitDate: f[8],
+            Time: time.Unix(ct, 0), Message: strings.TrimRight(f[10], "\n") + "\n",
+        })
+    }
+    return chain, nil
+}
+
+// retain marks which snapshots of a newest-first chain the policy keeps.
+// Pinned shas (published anchors) are always kept, as is the tip.
+func (p keepPolicy) retain(chain []chainCommit, pinned map[string]bool) []bool {
+    keep := make([]bool, len(chain))
+    hours := map[string]bool{}
+    days := map[string]bool{}
+    for i, c := range chain {
+        if i < p.Recent || i == 0 || pinned[c.Sha] { keep[i] = true }
+        t := c.Time.Local()
+        if h := t.Format("2006-01-02T15"); !hours[h] && len(hours) < p.Hourly {
+            hours[h] = true
+            keep[i] = true
+        }
+        if d := t.Format("2006-01-02"); !days[d] && len(days) < p.Daily {
+            days[d] = true
+            keep[i] = true
+        }
+    }
+    return keep
+}
+
+// gcRef rewrites ref to the snapshots retained by the policy. Pinned
+// commits are always kept but may be rewritten, and their anchors are
+// remapped. Frozen (tagged) commits are never rewritten: the chain is left
+// as is from the newest of them down, so tags stay on the chain. It returns
+// the number kept and dropped; nothing is written when dryRun is set.
+func gcRef(ref string, p keepPolicy, pinned, frozen map[string]bool, dryRun bool) (int, int, error) {
+    tip, err := git("rev-parse", "-q", "--verify", ref+"^{commit}")
+    if err != nil { return 0, 0, nil }
+    chain, err := readChain(tip)
+    if err != nil { return 0, 0, err }
+    keep := p.retain(chain, pinned)
+    for i, c := range chain {
+        if !frozen[c.Sha] { continue }
+        for j := i; j < len(keep); j++ { keep[j] = true }
+        break
+    }
+    kept := 0
+    for _, k := range keep {
+        if k { kept++ }
+    }
+    dropped := len(chain) - kept
+    if dropped == 0 || dryRun { return kept, dropped, nil }
+
+    // Rebuild oldest-first; the untouched prefix keeps its original shas.
+    parent := ""
+    rewriting := false
+    remap := map[string]string{}
+    for i := len(chain) - 1; i >= 0; i-- {
+        c := chain[i]
+        if !keep[i] {
+            rewriting = true
+            continue
+        }
+        if !rewriting {
+            parent = c.Sha
+            continue
+        }
+        args := []string{"commit-tree", c.Tree}
+        if parent != "" { args = append(args, "-p", parent) }
+        // Preserve non-chain parents (e.g. side trees) as-is
+        if len(c.Parents) > 1 {
+            for _, extra := range c.Parents[1:] { args = append(args, "-p", extra) }
+        }
+        env := map[string]string{
+            "GIT_AUTHOR_NAME": c.AuthorName, "GIT_AUTHOR_EMAIL": c.AuthorMail, "GIT_AUTHOR_DATE": c.AuthorDate,
+            "GIT_COMMITTER_NAME": c.CommitName, "GIT_COMMITTER_EMAIL": c.CommitMail, "GIT_COMMITTER_DATE": c.CommitDate,
+        }
+        sha, err := gitEnvInput(env, c.Message, args...)
+        if err != nil { return 0, 0, err }
+        if pinned[c.Sha] { remap[c.Sha] = sha }
+        parent = sha
+    }
+    // Compare-and-swap so a snapshot written meanwhile is never lost
+    if _, err := git("update-ref", "-m", fmt.Sprintf("aigit gc: kept %d of %d", kept, len(chain)), ref, parent, tip); err != nil {
+        return 0, 0, fmt.Errorf("%s moved during gc; try again: %w", ref, err)
+    }
+    for oldSha, newSha := range remap { remapPinned(oldSha, newSha) }
+    return kept, dropped, nil
+}
+
+// gcIndex drops the staging areas on the index chain that no snapshot of
+// chains refers to any more. The tip is rebuilt from the ones still in use.
+func gcIndex(branch string, chains []string, dryRun bool) (int, int, error) {
+    ref := indexRef(branch)
+    tip, err := revParse(ref + "^{commit}")
+    if err != nil { return 0, 0, nil }
+    used := map[string]bool{}
+    for _, c := range chains {
+        out, err := git("log", "--first-parent", "--format=%(trailers:key=Aigit-Index,valueonly)", c, "--")
+        if err != nil { continue }
+        for _, t := range strings.Fields(out) { used[t] = true }
+    }
+    chain, err := readChain(tip)
+    if err != nil { return 0, 0, err }
+    kept := 0
+    for _, c := range chain {
+        if used[c.Tree] { kept++ }
+    }
+    dropped := len(chain) - kept
+    if dropped == 0 || dryRun { return kept, dropped, nil }
+    parent := ""
+    for i := len(chain) - 1; i >= 0; i-- {
+        if !used[chain[i].Tree] { continue }
+        args := []string{"commit-tree", chain[i].Tree}
+        if parent != "" { args = append(args, "-p", parent) }
+        sha, err := gitInput(chain[i].Message, args...)
+        if err != nil { return 0, 0, err }
+        parent = sha
+    }
+    if parent == "" {
+        _, err = git("update-ref", "-d", ref, tip)
+    } else {
+        _, err = git("update-ref", "-m", fmt.Sprintf("aigit gc: kept %d of %d", kept, len(chain)), ref, parent, tip)
+    }
+    if err != nil { return 0, 0, fmt.Errorf("%s moved during gc; try again: %w", ref, err) }
+    return kept, dropped, nil
+}
+
+// pinnedSnapshots returns snapshots that must survive rewrites (publish anchors).
+func pinnedSnapshots() map[string]bool {
+    pinned := map[string]bool{}
+    out, err := git("for-each-ref", "--format=%(objectname)", "refs/aigit/published/")
+    if err != nil { return pinned }
+    for _, sha := range strings.Fields(out) { pinned[sha] = true }
+    return pinned
+}
+
+// frozenSnapshots returns tagged snapshots, which are exempt from retention
+// and rewrite. Their tags are never moved, so a name always resolves to the
+// same sha.
+func frozenSnapshots() map[string]bool {
+    frozen := map[string]bool{}
+    out, err := git("for-each-ref", "--format=%(objectname)", refRoot()+"tags/")
+    if err != nil { return frozen }
+    for _, sha := range strings.Fields(out) { frozen[sha] = true }
+    return frozen
+}
+
+// remapPinned moves anchor refs that pointed at a rewritten commit.
+func remapPinned(oldSha, newSha string) {
+    out, err := git("for-each-ref", "--format=%(objectname) %(refname)", "refs/aigit/published/")
+    if err != nil { return }
+    for _, line := range strings.Split(out, "\n") {
+        parts := strings.Fields(line)
+        if len(parts) == 2 && parts[0] == oldSha {
+            _, _ = git("update-ref", "-m", "aigit gc: remap", parts[1], newSha, oldSha)
+        }
+    }
+}
+
+// doGC applies the retention policy to the current branch's checkpoint, live
+// and undo chains and force-pushes rewritten shared chains.
+func doGC(dryRun, push bool) error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    ck, err := ckRef()
+    if err != nil { return err }
+    p := loadKeepPolicy()
+    pinned := pinnedSnapshots()
+    frozen := frozenSnapshots()
+    rewritten := map[string]bool{}
+    chains := []string{ck, liveLocalRef(br), undoRef(br)}
+    for _, ref := range chains {
+        kept, dropped, err := gcRef(ref, p, pinned, frozen, dryRun)
+        if err != nil { return err }
+        if kept == 0 && dropped == 0 { continue }
+        verb := "pruned"
+        if dryRun { verb = "would prune" }
+        fmt.Printf("%s: kept %d, %s %d\n", ref, kept, verb, dropped)
+        if dropped > 0 && !dryRun {
+            logLine("GC %s: kept %d, pruned %d", ref, kept, dropped)
+            rewritten[ref] = true
+        }
+    }
+    if kept, dropped, err := gcIndex(br, chains, dryRun); err != nil {
+        return err
+    } else if dropped > 0 {
+        verb := "pruned"
+        if dryRun { verb = "would prune" }
+        fmt.Printf("%s: kept %d, %s %d\n", indexRef(br), kept, verb, dropped)
+    }
+    if !push || len(rewritten) == 0 { return nil }
+    remote := strings.TrimSpace(getGitConfig("aigit.pushRemote"))
+    if remote == "" && hasRemote("origin") { remote = "origin" }
+    if remote == "" { return nil }
+    if rewritten[liveLocalRef(br)] {
+        if err := pushLive(remote); err != nil { fmt.Fprintf(os.Stderr, "push live failed: %v\n", err) }
+    }
+    // Checkpoints are opt-in shares: only replace them if they were pushed before
+    if rewritten[ck] {
+        if out, err := git("ls-remote", remote, userRemoteRef(remoteUserID(), br)); err == nil && strings.TrimSpace(out) != "" {
+            if err := pushCheckpoints(remote); err != nil { fmt.Fprintf(os.Stderr, "push checkpoints failed: %v\n", err) }
+        }
+    }
+    return nil
+}
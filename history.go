@@ -0,0 +1,235 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Per-file history across snapshot chains ----
+
+// historySource picks the chain to walk: local checkpoints by default, the
+// live chain with --live, or a teammate's fetched live chain with --user.
+func historySource(live bool, user string) string {
+    switch {
+    case user != "":
+        return "user:" + user
+    case live:
+        return "live"
+    }
+    return "ck"
+}
+
+// chainRef resolves a history source (ck, live, user:<id>) to its ref.
+func chainRef(from string) (string, error) {
+    ref, err := expandRevName(from)
+    if err != nil { return "", err }
+    if _, err := git("rev-parse", "-q", "--verify", ref+"^{commit}"); err != nil {
+        return "", fmt.Errorf("no snapshots on %s", from)
+    }
+    return ref, nil
+}
+
+// fileLogEntry is one snapshot that changed the file, with the numstat
+// lines ("added\tdeleted\tpath") of the paths it changed.
+type fileLogEntry struct {
+    Sha, Subject string
+    Time         time.Time
+    Stats        [][3]string
+}
+
+// fileLog returns the snapshots on a chain that changed path, newest first.
+func fileLog(from, path string, limit int) ([]fileLogEntry, error) {
+    ref, err := chainRef(from)
+    if err != nil { return nil, err }
+    out, err := git("--no-pager", "log", "--first-parent", "-n", strconv.Itoa(limit), "--format=%x1e%H%x09%ct%x09%s", "--numstat", ref, "--", path)
+    if err != nil { return nil, err }
+    var entries []fileLogEntry
+    for _, rec := range strings.Split(out, "\x1e") {
+        lines := strings.Split(strings.TrimSpace(rec), "\n")
+        parts := strings.SplitN(lines[0], "\t", 3)
+        if len(parts) < 3 { continue }
+        ct, _ := strconv.ParseInt(parts[1], 10, 64)
+        e := fileLogEntry{Sha: parts[0], Time: time.Unix(ct, 0), Subject: parts[2]}
+        for _, ln := range lines[1:] {
+            stat := strings.SplitN(ln, "\t", 3)
+            if len(stat) < 3 { continue }
+            e.Stats = append(e.Stats, [3]string{stat[0], stat[1], stat[2]})
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+// doFileLog lists the snapshots on a chain that changed path, each with its
+// per-file diffstat.
+func doFileLog(from, path string, limit int) error {
+    entries, err := fileLog(from, path, limit)
+    if err != nil { return err }
+    if len(entries) == 0 {
+        fmt.Printf("No snapshots on %s changed %s.\n", from, path)
+        return nil
+    }
+    for _, e := range entries {
+        fmt.Printf("%s  %6s  %s\n", short(e.Sha), relTime(time.Since(e.Time)), e.Subject)
+        for _, stat := range e.Stats {
+            fmt.Printf("    +%s -%s  %s\n", stat[0], stat[1], stat[2])
+        }
+    }
+    return nil
+}
+
+// blameCommit is what a blame line is attributed to.
+type blameCommit struct {
+    User, Subject string
+    Time          time.Time
+    Committed     bool // a commit of the branch history, not a snapshot
+}
+
+// blameLine is one line of the file and the commit it is attributed to.
+type blameLine struct {
+    Sha, Text string
+}
+
+// blameResult is the blame of a file: its lines and, in order of first
+// appearance, the commits they are attributed to. Worktree is the throwaway
+// commit that lines not snapshotted yet are attributed to.
+type blameResult struct {
+    Lines    []blameLine
+    Order    []string
+    Commits  map[string]*blameCommit
+    Worktree string
+}
+
+// blameFile attributes each line of the current file to the snapshot (and
+// its user) that last touched it. Lines never snapshotted show as the worktree.
+func blameFile(from, path string) (blameResult, error) {
+    res := blameResult{Commits: map[string]*blameCommit{}}
+    ref, err := chainRef(from)
+    if err != nil { return res, err }
+    // Blame a throwaway commit of the worktree on top of the chain, so lines
+    // not yet snapshotted are attributed to it (blame --contents with a
+    // revision needs git 2.41).
+    tree, err := snapshotTree()
+    if err != nil { return res, err }
+    wt, err := git("commit-tree", tree, "-p", ref, "-m", "worktree")
+    if err != nil { return res, err }
+    env, cleanup := graftChainBase(ref)
+    defer cleanup()
+    if env != nil {
+        top, err := topPaths([]string{path})
+        if err != nil { return res, err }
+        path = top[0]
+    }
+    out, err := gitEnv(env, "blame", "--porcelain", wt, "--", path)
+    if err != nil { return res, err }
+    res.Worktree = wt
+    lookup := func(sha string) {
+        if _, ok := res.Commits[sha]; ok { return }
+        c := &blameCommit{User: "(worktree)", Subject: "not checkpointed yet"}
+        if sha != wt {
+            if body, err := git("show", "-s", "--format=%ct%x1f%ae%x1f%s%x1f%B", sha); err == nil {
+                f := strings.SplitN(body, "\x1f", 4)
+                if len(f) == 4 {
+                    ct, _ := strconv.ParseInt(f[0], 10, 64)
+                    c.Time = time.Unix(ct, 0)
+                    m := parseMeta(f[3])
+                    c.User = defaultStr(m.User, sanitizeID(f[1]))
+                    c.Subject = f[2]
+                    c.Committed = m.Base == "" && m.Kind == ""
+                }
+            }
+        }
+        res.Commits[sha] = c
+        res.Order = append(res.Order, sha)
+    }
+    var sha string
+    for _, ln := range strings.Split(out, "\n") {
+        if strings.HasPrefix(ln, "\t") {
+            lookup(sha)
+            res.Lines = append(res.Lines, blameLine{Sha: sha, Text: ln[1:]})
+            continue
+        }
+        // Header lines start with a 40-hex sha followed by line numbers
+        if f := strings.Fields(ln); len(f) >= 3 && len(f[0]) == 40 && isHex(f[0]) {
+            sha = f[0]
+        }
+    }
+    return res, nil
+}
+
+// graftChainBase makes blame see the oldest snapshot of ref as a child of
+// the commit it was taken on (its Aigit-Base), so lines that predate aigit
+// are attributed to the branch history rather than to the first snapshot.
+// The graft is a replace ref in a throwaway bare repository that borrows
+// this one's objects, so nothing is written here even if aigit is killed.
+// Blame runs there through the returned environment, with paths relative
+// to the top level; cleanup removes it.
+func graftChainBase(ref string) (map[string]string, func()) {
+    none := func() {}
+    root, err := git("rev-list", "--first-parent", "--max-parents=0", ref)
+    if err != nil || root == "" || strings.Contains(root, "\n") { return nil, none }
+    body, err := commitBody(root)
+    if err != nil { return nil, none }
+    base, err := revParse(parseMeta(body).Base + "^{commit}")
+    if err != nil { return nil, none }
+    // The graft keeps the snapshot's identity; the throwaway repo has no config
+    who, err := git("show", "-s", "--format=%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI", root)
+    f := strings.Split(who, "\x1f")
+    if err != nil || len(f) != 6 { return nil, none }
+    objects, err := git("rev-parse", "--path-format=absolute", "--git-path", "objects")
+    if err != nil { return nil, none }
+    format, err := git("rev-parse", "--show-object-format")
+    if err != nil { return nil, none }
+
+    tmp, err := os.MkdirTemp("", "aigit-blame-")
+    if err != nil { return nil, none }
+    cleanup := func() { os.RemoveAll(tmp) }
+    env := map[string]string{"GIT_DIR": tmp}
+    graftEnv := map[string]string{
+        "GIT_DIR": tmp,
+        "GIT_AUTHOR_NAME": f[0], "GIT_AUTHOR_EMAIL": f[1], "GIT_AUTHOR_DATE": f[2],
+        "GIT_COMMITTER_NAME": f[3], "GIT_COMMITTER_EMAIL": f[4], "GIT_COMMITTER_DATE": f[5],
+    }
+    _, err = git("init", "-q", "--bare", "--object-format="+format, tmp)
+    if err == nil { err = os.WriteFile(filepath.Join(tmp, "objects", "info", "alternates"), []byte(objects+"\n"), 0o644) }
+    var graft string
+    if err == nil { graft, err = gitEnvInput(graftEnv, body, "commit-tree", root+"^{tree}", "-p", base) }
+    if err == nil { _, err = gitEnv(env, "update-ref", "refs/replace/"+root, graft) }
+    if err != nil {
+        cleanup()
+        return nil, none
+    }
+    return env, cleanup
+}
+
+// doBlame prints each line with its snapshot, user and age, followed by the
+// subjects of those snapshots.
+func doBlame(from, path string) error {
+    res, err := blameFile(from, path)
+    if err != nil { return err }
+    for i, l := range res.Lines {
+        c := res.Commits[l.Sha]
+        rel := "-"
+        if !c.Time.IsZero() { rel = relTime(time.Since(c.Time)) }
+        fmt.Printf("%s  %-20s %6s %5d| %s\n", short(l.Sha), c.User, rel, i+1, l.Text)
+    }
+    fmt.Println("")
+    for _, s := range res.Order {
+        c := res.Commits[s]
+        note := ""
+        if c.Committed { note = "  (commit, before the first snapshot)" }
+        fmt.Printf("%s  %s%s\n", short(s), c.Subject, note)
+    }
+    return nil
+}
+
+func isHex(s string) bool {
+    for _, r := range s {
+        if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') { return false }
+    }
+    return true
+}
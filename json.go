@@ -0,0 +1,380 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Machine-readable output (--json) ----
+//
+// Field names are part of the public interface used by editor plugins and
+// scripts: add fields, never rename or remove them.
+
+type fileJSON struct {
+    Status string `json:"status"`
+    Path   string `json:"path"`
+}
+
+type submoduleJSON struct {
+    Path string `json:"path"`
+    Sha  string `json:"sha"`
+}
+
+type snapshotJSON struct {
+    Sha           string            `json:"sha"`
+    FullSha       string            `json:"full_sha"`
+    Subject       string            `json:"subject"`
+    Timestamp     string            `json:"timestamp"`
+    Trailers      map[string]string `json:"trailers"` // last value of a repeated key
+    Files         []fileJSON        `json:"files"`
+    SummarySource string            `json:"summary_source"`
+    Tags          []string          `json:"tags"`
+    User          string            `json:"user,omitempty"`
+    Remote        string            `json:"remote,omitempty"`
+    Scope         []string          `json:"scope"`      // every Aigit-Scope trailer
+    Submodules    []submoduleJSON   `json:"submodules"` // every Aigit-Submodule trailer
+    Conflicts     []string          `json:"conflicts"`  // every Aigit-Conflicts trailer
+}
+
+// snapshotInfo loads one snapshot commit in the stable JSON schema.
+func snapshotInfo(sha string, tags map[string][]string) (snapshotJSON, error) {
+    out, err := git("show", "-s", "--format=%H%x1f%ct%x1f%s%x1f%B", sha)
+    if err != nil { return snapshotJSON{}, err }
+    f := strings.SplitN(out, "\x1f", 4)
+    if len(f) < 4 { return snapshotJSON{}, fmt.Errorf("unexpected commit format for %s", sha) }
+    ct, _ := strconv.ParseInt(f[1], 10, 64)
+    m := parseMeta(f[3])
+    s := snapshotJSON{
+        Sha:           short(f[0]),
+        FullSha:       f[0],
+        Subject:       f[2],
+        Timestamp:     time.Unix(ct, 0).UTC().Format(time.RFC3339),
+        Trailers:      m.Trailers,
+        Files:         []fileJSON{},
+        SummarySource: m.Trailers["Aigit-Summary-Source"],
+        Tags:          []string{},
+        Scope:         []string{},
+        Submodules:    []submoduleJSON{},
+        Conflicts:     []string{},
+    }
+    if names := tags[f[0]]; len(names) > 0 { s.Tags = names }
+    if len(m.Scope) > 0 { s.Scope = m.Scope }
+    if len(m.Conflicts) > 0 { s.Conflicts = m.Conflicts }
+    for _, v := range m.Submodules {
+        if sha, p, ok := strings.Cut(v, " "); ok { s.Submodules = append(s.Submodules, submoduleJSON{Path: p, Sha: sha}) }
+    }
+    if files, err := git("diff-tree", "--root", "--no-commit-id", "-r", "-z", "--name-status", f[0]); err == nil {
+        fields := splitNul(files)
+        for i := 0; i+1 < len(fields); i += 2 {
+            s.Files = append(s.Files, fileJSON{Status: fields[i], Path: fields[i+1]})
+        }
+    }
+    return s, nil
+}
+
+// snapshotsJSON loads the newest limit snapshots on ref.
+func snapshotsJSON(ref string, limit int, tags map[string][]string) ([]snapshotJSON, error) {
+    list := []snapshotJSON{}
+    out, err := git("log", "-n", strconv.Itoa(limit), "--format=%H", ref)
+    if err != nil { return list, err }
+    for _, sha := range strings.Fields(out) {
+        s, err := snapshotInfo(sha, tags)
+        if err != nil { return list, err }
+        list = append(list, s)
+    }
+    return list, nil
+}
+
+func printJSON(v any) error {
+    b, err := json.MarshalIndent(v, "", "  ")
+    if err != nil { return err }
+    fmt.Println(string(b))
+    return nil
+}
+
+func doListJSON(limit int) error {
+    ref, err := ckRef()
+    if err != nil { return err }
+    br, _ := currentBranch()
+    list := []snapshotJSON{}
+    if _, err := git("rev-parse", "-q", "--verify", ref); err == nil {
+        if list, err = snapshotsJSON(ref, limit, branchTags(br)); err != nil { return err }
+    }
+    return printJSON(list)
+}
+
+type diffJSON struct {
+    From  *snapshotJSON `json:"from"` // null for the worktree
+    To    *snapshotJSON `json:"to"`
+    Files []fileJSON    `json:"files"`
+}
+
+func doDiffJSON(opts diffOptions) error {
+    a, b, err := diffRevs(opts)
+    if err != nil { return err }
+    d := diffJSON{Files: []fileJSON{}}
+    var trees [2]string
+    for i, r := range []rev{a, b} {
+        if trees[i], err = r.treeish(); err != nil { return err }
+        if r.Worktree { continue }
+        s, err := snapshotInfo(r.Commit, nil)
+        if err != nil { return err }
+        if i == 0 { d.From = &s } else { d.To = &s }
+    }
+    out, err := git(append([]string{"diff", "-z", "--name-status", "--no-renames", trees[0], trees[1], "--"}, opts.Paths...)...)
+    if err != nil { return err }
+    fields := splitNul(out)
+    for i := 0; i+1 < len(fields); i += 2 {
+        d.Files = append(d.Files, fileJSON{Status: fields[i], Path: fields[i+1]})
+    }
+    return printJSON(d)
+}
+
+func doUndoListJSON(limit int) error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    list := []snapshotJSON{}
+    if _, err := git("rev-parse", "-q", "--verify", undoRef(br)); err == nil {
+        if list, err = snapshotsJSON(undoRef(br), limit, nil); err != nil { return err }
+    }
+    return printJSON(list)
+}
+
+// doTagListJSON prints each tagged snapshot once, with all its names.
+func doTagListJSON() error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    tags := branchTags(br)
+    list := []snapshotJSON{}
+    out, err := git("for-each-ref", "--format=%(objectname)", tagPrefix(br))
+    if err != nil { return err }
+    seen := map[string]bool{}
+    for _, sha := range strings.Fields(out) {
+        if seen[sha] { continue }
+        seen[sha] = true
+        s, err := snapshotInfo(sha, tags)
+        if err != nil { return err }
+        list = append(list, s)
+    }
+    return printJSON(list)
+}
+
+type searchHitJSON struct {
+    snapshotJSON
+    Source  string `json:"source"`            // ck, live, <user>/live, <user>/checkpoints
+    Present *bool  `json:"present,omitempty"` // -S/-G: the content is in this snapshot
+}
+
+func doSearchJSON(opts searchOptions) error {
+    _, _, hits, err := searchHits(opts)
+    if err != nil { return err }
+    if opts.Limit > 0 && len(hits) > opts.Limit { hits = hits[:opts.Limit] }
+    list := []searchHitJSON{}
+    for _, h := range hits {
+        s, err := snapshotInfo(h.Sha, nil)
+        if err != nil { return err }
+        s.User = h.Source.User
+        hit := searchHitJSON{snapshotJSON: s, Source: h.Source.Label}
+        if opts.S != "" || opts.G != "" {
+            present := h.Present
+            hit.Present = &present
+        }
+        list = append(list, hit)
+    }
+    return printJSON(list)
+}
+
+type fileStatJSON struct {
+    Path      string `json:"path"`
+    Additions int    `json:"additions"`
+    Deletions int    `json:"deletions"`
+    Binary    bool   `json:"binary,omitempty"`
+}
+
+type fileLogJSON struct {
+    snapshotJSON
+    Stats []fileStatJSON `json:"stats"` // the logged path's diffstat
+}
+
+func doFileLogJSON(from, path string, limit int) error {
+    entries, err := fileLog(from, path, limit)
+    if err != nil { return err }
+    list := []fileLogJSON{}
+    for _, e := range entries {
+        s, err := snapshotInfo(e.Sha, nil)
+        if err != nil { return err }
+        l := fileLogJSON{snapshotJSON: s, Stats: []fileStatJSON{}}
+        for _, st := range e.Stats {
+            add, err1 := strconv.Atoi(st[0])
+            del, err2 := strconv.Atoi(st[1])
+            l.Stats = append(l.Stats, fileStatJSON{Path: st[2], Additions: add, Deletions: del, Binary: err1 != nil || err2 != nil})
+        }
+        list = append(list, l)
+    }
+    return printJSON(list)
+}
+
+type blameLineJSON struct {
+    Line int    `json:"line"`
+    Sha  string `json:"sha"` // full sha of the snapshot; "" when not snapshotted yet
+    Text string `json:"text"`
+}
+
+type blameJSON struct {
+    Path      string          `json:"path"`
+    Lines     []blameLineJSON `json:"lines"`
+    Snapshots []snapshotJSON  `json:"snapshots"` // in order of first appearance
+}
+
+func doBlameJSON(from, path string) error {
+    res, err := blameFile(from, path)
+    if err != nil { return err }
+    b := blameJSON{Path: path, Lines: []blameLineJSON{}, Snapshots: []snapshotJSON{}}
+    for i, l := range res.Lines {
+        sha := l.Sha
+        if sha == res.Worktree { sha = "" }
+        b.Lines = append(b.Lines, blameLineJSON{Line: i + 1, Sha: sha, Text: l.Text})
+    }
+    for _, sha := range res.Order {
+        if sha == res.Worktree { continue }
+        s, err := snapshotInfo(sha, nil)
+        if err != nil { return err }
+        s.User = res.Commits[sha].User
+        b.Snapshots = append(b.Snapshots, s)
+    }
+    return printJSON(b)
+}
+
+type statusJSON struct {
+    Branch         string        `json:"branch"`
+    LastCheckpoint *snapshotJSON `json:"last_checkpoint"`
+    Merging        bool          `json:"merging"`
+    Conflicts      []string      `json:"conflicts"`
+    Changes        []fileJSON    `json:"changes"`
+    Clean          bool          `json:"clean"`
+}
+
+func doStatusJSON() error {
+    ref, err := ckRef()
+    if err != nil { return err }
+    br, _ := currentBranch()
+    st := statusJSON{Branch: br, Conflicts: []string{}, Changes: []fileJSON{}}
+    if sha, err := git("rev-parse", "-q", "--verify", ref+"^{commit}"); err == nil {
+        if s, err := snapshotInfo(sha, branchTags(br)); err == nil { st.LastCheckpoint = &s }
+    }
+    st.Merging = isMerging()
+    if st.Merging {
+        if conflicts, _ := listConflicts(); len(conflicts) > 0 { st.Conflicts = conflicts }
+    }
+    out, err := git("diff", "-z", "--name-status")
+    if err != nil { return err }
+    fields := splitNul(out)
+    for i := 0; i+1 < len(fields); i += 2 {
+        st.Changes = append(st.Changes, fileJSON{Status: fields[i], Path: fields[i+1]})
+    }
+    if untracked, err := git("ls-files", "-z", "--others", "--exclude-standard"); err == nil {
+        for _, p := range splitNul(untracked) {
+            st.Changes = append(st.Changes, fileJSON{Status: "?", Path: p})
+        }
+    }
+    st.Clean = len(st.Changes) == 0
+    return printJSON(st)
+}
+
+type idJSON struct {
+    User       string `json:"user"`
+    Branch     string `json:"branch"`
+    LocalRef   string `json:"local_ref"`
+    LiveRef    string `json:"live_ref"`
+    PushRemote string `json:"push_remote"`
+    PushTarget string `json:"push_target"`
+    PullRemote string `json:"pull_remote"`
+    PullSource string `json:"pull_source"`
+}
+
+func doIDJSON() error {
+    uid := remoteUserID()
+    br, _ := currentBranch()
+    local, _ := ckRef()
+    id := idJSON{
+        User:       uid,
+        Branch:     br,
+        LocalRef:   local,
+        LiveRef:    liveLocalRef(br),
+        PushRemote: strings.TrimSpace(getGitConfig("aigit.pushRemote")),
+        PullRemote: strings.TrimSpace(getGitConfig("aigit.pullRemote")),
+    }
+    if id.PushRemote != "" { id.PushTarget = userRemoteRef(uid, br) }
+    if id.PullRemote != "" { id.PullSource = remoteTrackingRef(id.PullRemote, uid, br) }
+    return printJSON(id)
+}
+
+type remoteUsersJSON struct {
+    Remote string   `json:"remote"`
+    Branch string   `json:"branch"`
+    Users  []string `json:"users"`
+}
+
+func doRemoteListJSON(remote, user string, limit int) error {
+    if strings.TrimSpace(remote) == "" { remote = "origin" }
+    _ = fetchCheckpoints(remote)
+    br, err := currentBranch()
+    if err != nil { return err }
+    if strings.TrimSpace(user) == "" {
+        users, err := listRemoteUsers(remote, br)
+        if err != nil { return err }
+        if users == nil { users = []string{} }
+        return printJSON(remoteUsersJSON{Remote: remote, Branch: br, Users: users})
+    }
+    ref := remoteTrackingRef(remote, user, br)
+    if _, err := git("rev-parse", "-q", "--verify", ref); err != nil {
+        return fmt.Errorf("no checkpoints for user %s on %s", user, br)
+    }
+    list, err := snapshotsJSON(ref, limit, nil)
+    if err != nil { return err }
+    for i := range list {
+        list[i].User = user
+        list[i].Remote = remote
+    }
+    return printJSON(list)
+}
+
+// eventJSON is one NDJSON record streamed by `aigit events --json`.
+type eventJSON struct {
+    Type     string        `json:"type"` // checkpoint|live|apply|summary|file|log
+    Text     string        `json:"text"`
+    Snapshot *snapshotJSON `json:"snapshot,omitempty"`
+}
+
+// eventFromLine classifies one log line; checkpoint and live lines carry the
+// full snapshot record.
+func eventFromLine(line string) eventJSON {
+    ev := eventJSON{Type: "log", Text: line}
+    switch {
+    case strings.HasPrefix(line, "Checkpoint: "), strings.HasPrefix(line, "Live: "):
+        ev.Type = "checkpoint"
+        if strings.HasPrefix(line, "Live: ") { ev.Type = "live" }
+        fields := strings.Fields(line)
+        if len(fields) > 1 {
+            if s, err := snapshotInfo(fields[1], nil); err == nil { ev.Snapshot = &s }
+        }
+    case strings.HasPrefix(line, "Applying "):
+        ev.Type = "apply"
+    case strings.HasPrefix(line, "Summary: "):
+        ev.Type = "summary"
+    case strings.HasPrefix(line, "  ") && strings.Contains(line, "\t"):
+        ev.Type = "file"
+    }
+    return ev
+}
+
+func printEventJSON(line string) {
+    if strings.TrimSpace(line) == "" { return }
+    b, err := json.Marshal(eventFromLine(line))
+    if err != nil { return }
+    os.Stdout.Write(append(b, '\n'))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Repo lock ----
+//
+// Snapshot writes (manual checkpoints, the watcher, undo points, agents
+// calling aigit) hold an exclusive lock file in aigitDir from reading the
+// worktree to moving the chain tip, so concurrent writers queue up instead
+// of racing on the private index and the refs. The lock holds the pid of
+// its owner and a random token. A lock left behind by a crashed process is
+// taken over once its pid is gone or, where that cannot be told, once it
+// is older than lockStale.
+
+const (
+    lockWait  = 30 * time.Second
+    lockStale = 2 * time.Minute
+)
+
+// lockRepo waits for the snapshot lock and returns its release function.
+func lockRepo() (func(), error) {
+    dir, err := aigitDir()
+    if err != nil { return nil, err }
+    path := filepath.Join(dir, "snapshot.lock")
+    deadline := time.Now().Add(lockWait)
+    delay := 2 * time.Millisecond
+    for {
+        f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+        if err == nil {
+            owner := fmt.Sprintf("%d %d\n", os.Getpid(), rand.Int63())
+            fmt.Fprint(f, owner)
+            f.Close()
+            // Only our own lock is removed, never one taken over meanwhile
+            return func() {
+                removeLockIf(path, func(b []byte, _ os.FileInfo) bool { return string(b) == owner })
+            }, nil
+        }
+        if !os.IsExist(err) { return nil, err }
+        if removeLockIf(path, lockAbandoned) { continue }
+        if time.Now().After(deadline) {
+            return nil, fmt.Errorf("another aigit process has been writing a snapshot for %s (%s); delete the lock if no aigit is running", lockWait, path)
+        }
+        time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+        if delay < 100*time.Millisecond { delay *= 2 }
+    }
+}
+
+// removeLockIf removes the lock at path if match holds for it. The lock is
+// renamed aside before it is checked, so only one process gets to look at
+// a given lock file, and one that no longer matches (a waiter took the lock
+// over in between) is linked back in place.
+func removeLockIf(path string, match func(b []byte, fi os.FileInfo) bool) bool {
+    fi, err := os.Stat(path)
+    if err != nil { return false }
+    b, err := os.ReadFile(path)
+    if err != nil || !match(b, fi) { return false }
+    aside := fmt.Sprintf("%s.%d.%d", path, os.Getpid(), rand.Int63())
+    if err := os.Rename(path, aside); err != nil { return false }
+    defer os.Remove(aside)
+    fi, err = os.Stat(aside)
+    if err != nil { return false }
+    if b, err = os.ReadFile(aside); err == nil && match(b, fi) { return true }
+    if err := os.Link(aside, path); err != nil {
+        fmt.Fprintf(os.Stderr, "aigit: could not put back the snapshot lock %s: %v\n", path, err)
+    }
+    return false
+}
+
+// lockAbandoned reports whether the holder of a lock is gone.
+func lockAbandoned(b []byte, fi os.FileInfo) bool {
+    fields := strings.Fields(string(b))
+    if len(fields) > 0 {
+        if pid, err := strconv.Atoi(fields[0]); err == nil {
+            if alive, known := pidAlive(pid); known { return !alive }
+        }
+    }
+    // No pid to check (or a lock still being written): go by its age
+    return time.Since(fi.ModTime()) > lockStale
+}
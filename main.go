@@ -9,6 +9,7 @@ import (
     "io"
     "os"
     "os/exec"
+    "path"
     "path/filepath"
     "strconv"
     "strings"
@@ -23,6 +24,13 @@ var (
     quietEcho = false
     // window to suppress creating a new local snapshot right after applying from remote
     suppressSnapshotsUntil time.Time
+    // branch the watcher last snapshotted on, to notice checkouts
+    watchedBranch string
+    // paths the watcher saw change since the last live snapshot (nil outside watch)
+    fsChanges *pathSet
+    // tree of the last live snapshot auto-applied from a teammate, so the
+    // watcher does not echo it back as a snapshot of its own
+    appliedTree string
 )
 
 func main() {
@@ -79,10 +87,35 @@ func main() {
         fs := flag.NewFlagSet("checkpoint", flag.ExitOnError)
         msg := fs.String("m", "(auto)", "one-line summary message")
         q := fs.Bool("q", false, "quiet (suppress local echo; shell integration will display updates)")
-        if err := fs.Parse(args); err != nil { fatal(err) }
+        tag := fs.String("t", "", "name the new checkpoint (usable wherever a sha is accepted)")
+        fromStash := fs.String("from-stash", "", "import a stash entry (e.g. stash@{0}) instead of the worktree")
+        pos, paths, err := parseArgs(fs, args)
+        if err != nil { fatal(err) }
+        if len(pos) > 0 { fatal(errors.New("usage: aigit checkpoint [-m msg] [-t name] [-- <pathspec>...]")) }
         quietEcho = *q
-        if err := doCheckpoint(*msg); err != nil { fatal(err) }
+        if *fromStash != "" {
+            if len(paths) > 0 { fatal(errors.New("--from-stash takes no pathspec")) }
+            if err := doCheckpointFromStash(*fromStash); err != nil { fatal(err) }
+            if *tag != "" {
+                if err := createTag("ck", *tag); err != nil { fatal(err) }
+            }
+            break
+        }
+        if *tag != "" {
+            if err := validateTagName(*tag); err != nil { fatal(err) }
+        }
+        if err := doCheckpoint(*msg, paths...); err != nil { fatal(err) }
+        if *tag != "" {
+            if err := createTag("ck", *tag); err != nil { fatal(err) }
+        }
     case "status":
+        fs := flag.NewFlagSet("status", flag.ExitOnError)
+        asJSON := fs.Bool("json", false, "machine-readable output")
+        if err := fs.Parse(args); err != nil { fatal(err) }
+        if *asJSON {
+            if err := doStatusJSON(); err != nil { fatal(err) }
+            break
+        }
         if err := doStatus(); err != nil {
             fatal(err)
         }
@@ -96,9 +129,10 @@ func main() {
         sessionID := fs.String("id", "", "unique session id for state (e.g., host:tty:pid)")
         back := fs.Int("n", 80, "lines to show on first run")
         follow := fs.Bool("follow", false, "follow and print events as they arrive")
+        asJSON := fs.Bool("json", false, "emit NDJSON records instead of raw log lines")
         if err := fs.Parse(args); err != nil { fatal(err) }
-        if strings.TrimSpace(*sessionID) == "" { fatal(errors.New("usage: aigit events -id <session-id> [-n N] [--follow]")) }
-        if err := doEvents(*sessionID, *back, *follow); err != nil { fatal(err) }
+        if strings.TrimSpace(*sessionID) == "" { fatal(errors.New("usage: aigit events -id <session-id> [-n N] [--follow] [--json]")) }
+        if err := doEvents(*sessionID, *back, *follow, *asJSON); err != nil { fatal(err) }
     case "init-shell":
         fs := flag.NewFlagSet("init-shell", flag.ExitOnError)
         zsh := fs.Bool("zsh", false, "install zsh integration (~/.zshrc)")
@@ -107,14 +141,31 @@ func main() {
         if !*zsh && !*bash { fatal(errors.New("usage: aigit init-shell --zsh|--bash")) }
         if err := doInitShell(*zsh, *bash); err != nil { fatal(err) }
     case "id":
+        fs := flag.NewFlagSet("id", flag.ExitOnError)
+        asJSON := fs.Bool("json", false, "machine-readable output")
+        if err := fs.Parse(args); err != nil { fatal(err) }
+        if *asJSON {
+            if err := doIDJSON(); err != nil { fatal(err) }
+            break
+        }
         if err := doID(); err != nil { fatal(err) }
     case "list":
         fs := flag.NewFlagSet("list", flag.ExitOnError)
         n := fs.Int("n", 20, "number of checkpoints to show")
         meta := fs.Bool("meta", false, "show metadata trailers")
+        asJSON := fs.Bool("json", false, "machine-readable output")
+        allWorktrees := fs.Bool("worktree", false, "list checkpoints of every worktree of this repository")
         if err := fs.Parse(args); err != nil {
             fatal(err)
         }
+        if *asJSON {
+            if err := doListJSON(*n); err != nil { fatal(err) }
+            break
+        }
+        if *allWorktrees {
+            if err := doListWorktrees(*n, *meta); err != nil { fatal(err) }
+            break
+        }
         if err := doList(*n, *meta); err != nil {
             fatal(err)
         }
@@ -146,7 +197,12 @@ func main() {
         user := fs.String("user", "", "filter by user id; if empty, list users")
         n := fs.Int("n", 20, "number of entries when listing a user")
         meta := fs.Bool("meta", false, "show metadata trailers when listing a user")
+        asJSON := fs.Bool("json", false, "machine-readable output")
         if err := fs.Parse(args); err != nil { fatal(err) }
+        if *asJSON {
+            if err := doRemoteListJSON(*remote, *user, *n); err != nil { fatal(err) }
+            break
+        }
         if err := doRemoteList(*remote, *user, *n, *meta); err != nil { fatal(err) }
     case "stop":
         if err := doStop(); err != nil { fatal(err) }
@@ -155,21 +211,156 @@ func main() {
         from := fs.String("from", "", "user id to apply from (required)")
         remote := fs.String("remote", defaultStr(getGitConfig("aigit.pullRemote"), "origin"), "remote name")
         sha := fs.String("sha", "", "checkpoint sha to apply (default latest)")
-        if err := fs.Parse(args); err != nil { fatal(err) }
+        var opts restoreOptions
+        fs.BoolVar(&opts.Exact, "exact", false, "mirror the checkpoint exactly (also remove files it does not contain)")
+        fs.BoolVar(&opts.WithState, "with-state", false, "recreate the merge/rebase in progress when the checkpoint was taken")
+        _, paths, err := parseArgs(fs, args)
+        if err != nil { fatal(err) }
+        opts.Paths = paths
         if strings.TrimSpace(*from) == "" { fatal(errors.New("--from <user> is required")) }
-        if err := applyRemoteCheckpoint(*remote, *from, *sha); err != nil { fatal(err) }
+        if err := applyRemoteCheckpoint(*remote, *from, *sha, opts); err != nil { fatal(err) }
     case "restore":
         fs := flag.NewFlagSet("restore", flag.ExitOnError)
-        if err := fs.Parse(args); err != nil {
+        var opts restoreOptions
+        fs.BoolVar(&opts.Exact, "exact", false, "mirror the checkpoint exactly (also remove files it does not contain)")
+        fs.BoolVar(&opts.Staged, "staged", false, "also restore the staging area recorded with the checkpoint")
+        fs.BoolVar(&opts.Staged, "index", false, "alias for --staged")
+        fs.BoolVar(&opts.WithState, "with-state", false, "recreate the merge/rebase in progress when the checkpoint was taken")
+        before := fs.String("before", "", "restore the newest snapshot taken before this time (10m, yesterday, 2026-10-17 14:00)")
+        pos, paths, err := parseArgs(fs, args)
+        if err != nil {
             fatal(err)
         }
-        if fs.NArg() < 1 {
-            fatal(errors.New("usage: aigit restore <sha>"))
+        if *before != "" {
+            // --before T [ref] is shorthand for ref@{T}
+            ref := ""
+            if len(pos) > 0 { ref = pos[0] }
+            if strings.ContainsAny(ref, "@~^") { fatal(errors.New("--before takes a plain ref (ck, live, user:<id>, a name)")) }
+            pos = []string{ref + "@{" + *before + "}"}
         }
-        sha := fs.Arg(0)
-        if err := doRestore(sha); err != nil {
+        if len(pos) < 1 {
+            fatal(errors.New("usage: aigit restore [--exact] [--staged] [--with-state] <sha> | --before <time> [-- <pathspec>...]"))
+        }
+        opts.Paths = paths
+        if err := doRestore(pos[0], opts); err != nil {
             fatal(err)
         }
+    case "search":
+        fs := flag.NewFlagSet("search", flag.ExitOnError)
+        var opts searchOptions
+        fs.StringVar(&opts.S, "S", "", "find snapshots where occurrences of this string changed")
+        fs.StringVar(&opts.G, "G", "", "find snapshots whose added/removed lines match this regex")
+        fs.StringVar(&opts.User, "user", "", "only search this user's snapshots")
+        fs.StringVar(&opts.Since, "since", "", "only snapshots newer than this age or date (e.g. 2h, 3d, 2026-10-01)")
+        fs.StringVar(&opts.Branch, "branch", "", "branch to search (default current)")
+        fs.IntVar(&opts.Limit, "n", 50, "maximum results to show")
+        asJSON := fs.Bool("json", false, "machine-readable output")
+        pos, _, err := parseArgs(fs, args)
+        if err != nil { fatal(err) }
+        opts.Text = strings.Join(pos, " ")
+        if *asJSON {
+            err = doSearchJSON(opts)
+        } else {
+            err = doSearch(opts)
+        }
+        if err != nil { fatal(err) }
+    case "log", "blame":
+        fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+        live := fs.Bool("live", false, "walk the live chain instead of checkpoints")
+        user := fs.String("user", "", "walk this teammate's fetched live chain")
+        limit := fs.Int("n", 50, "maximum checkpoints to show (log)")
+        asJSON := fs.Bool("json", false, "machine-readable output")
+        pos, paths, err := parseArgs(fs, args)
+        if err != nil { fatal(err) }
+        pos = append(pos, paths...)
+        if len(pos) != 1 { fatal(fmt.Errorf("usage: aigit %s [--live|--user id] [--json] <path>", cmd)) }
+        from := historySource(*live, *user)
+        switch {
+        case cmd == "log" && *asJSON:
+            err = doFileLogJSON(from, pos[0], *limit)
+        case cmd == "log":
+            err = doFileLog(from, pos[0], *limit)
+        case *asJSON:
+            err = doBlameJSON(from, pos[0])
+        default:
+            err = doBlame(from, pos[0])
+        }
+        if err != nil { fatal(err) }
+    case "tag":
+        fs := flag.NewFlagSet("tag", flag.ExitOnError)
+        del := fs.Bool("d", false, "delete the named tag")
+        asJSON := fs.Bool("json", false, "machine-readable output (list)")
+        pos, _, err := parseArgs(fs, args)
+        if err != nil { fatal(err) }
+        switch {
+        case *del && len(pos) == 1:
+            err = deleteTag(pos[0])
+        case len(pos) == 0 && !*del && *asJSON:
+            err = doTagListJSON()
+        case len(pos) == 0 && !*del:
+            err = doTagList()
+        case len(pos) == 2 && !*del:
+            err = createTag(pos[0], pos[1])
+        default:
+            err = errors.New("usage: aigit tag [<sha> <name> | -d <name>]")
+        }
+        if err != nil { fatal(err) }
+    case "gc":
+        fs := flag.NewFlagSet("gc", flag.ExitOnError)
+        dryRun := fs.Bool("dry-run", false, "only report what would be pruned")
+        noPush := fs.Bool("no-push", false, "do not force-push rewritten chains")
+        if err := fs.Parse(args); err != nil { fatal(err) }
+        if err := doGC(*dryRun, !*noPush); err != nil { fatal(err) }
+    case "stash":
+        if len(args) != 1 { fatal(errors.New("usage: aigit stash <sha>")) }
+        if err := doStashFromCheckpoint(args[0]); err != nil { fatal(err) }
+    case "bisect":
+        var err error
+        switch {
+        case len(args) == 3 && args[0] == "start":
+            err = doBisectStart(args[1], args[2])
+        case len(args) > 1 && args[0] == "run":
+            run := args[1:]
+            if run[0] == "--" { run = run[1:] }
+            err = doBisectRun(run)
+        case len(args) == 1 && args[0] == "reset":
+            err = doBisectReset()
+        default:
+            err = errors.New("usage: aigit bisect start <good> <bad> | run <cmd> [<args>...] | reset")
+        }
+        if err != nil { fatal(err) }
+    case "undo":
+        fs := flag.NewFlagSet("undo", flag.ExitOnError)
+        list := fs.Bool("list", false, "show the undo stack instead of undoing")
+        n := fs.Int("n", 20, "number of entries to show with --list")
+        asJSON := fs.Bool("json", false, "machine-readable output (with --list)")
+        if err := fs.Parse(args); err != nil { fatal(err) }
+        if *list && *asJSON {
+            if err := doUndoListJSON(*n); err != nil { fatal(err) }
+            break
+        }
+        if *list {
+            if err := doUndoList(*n); err != nil { fatal(err) }
+            break
+        }
+        if err := doUndo(); err != nil { fatal(err) }
+    case "diff":
+        opts, err := parseDiffArgs(args)
+        if err != nil { fatal(err) }
+        if err := doDiff(opts); err != nil { fatal(err) }
+    case "publish":
+        fs := flag.NewFlagSet("publish", flag.ExitOnError)
+        var opts publishOptions
+        fs.StringVar(&opts.Since, "since", "", "publish checkpoints after this sha")
+        fs.IntVar(&opts.Last, "last", 0, "publish the newest N checkpoints")
+        fs.BoolVar(&opts.Live, "live", false, "publish from the live ref instead of manual checkpoints")
+        fs.BoolVar(&opts.Rebase, "rebase", false, "replay checkpoints onto HEAD if it moved past their base")
+        fs.StringVar(&opts.Message, "m", "", "commit subject (default: summary of the range)")
+        fs.StringVar(&opts.Summary, "summary", defaultStr(getGitConfig("aigit.summary"), "ai"), "summary mode: ai|diff|off")
+        fs.StringVar(&opts.Model, "model", defaultStr(getGitConfig("aigit.summaryModel"), "openai/gpt-oss-20b:free"), "OpenRouter model when summary=ai")
+        if err := fs.Parse(args); err != nil { fatal(err) }
+        if opts.Since != "" && opts.Last > 0 { fatal(errors.New("usage: aigit publish [--since <sha>|--last N]")) }
+        if err := doPublish(opts); err != nil { fatal(err) }
     case "watch":
         fs := flag.NewFlagSet("watch", flag.ExitOnError)
         intervalStr := fs.String("interval", defaultStr(getGitConfig("aigit.interval"), "5m"), "checkpoint interval, e.g. 30s, 2m, 1h")
@@ -197,12 +388,23 @@ func main() {
 
 func printHelp() {
     fmt.Println("Aigit commands:")
-    fmt.Println("  aigit checkpoint -m \"summary\"    # save a manual snapshot (works during merges)")
+    fmt.Println("  aigit checkpoint -m \"summary\" [-t name] [-- paths]  # save a manual snapshot (works during merges; paths: scoped)")
     fmt.Println("  aigit checkpoint push [-remote origin]  # share manual checkpoints to remote")
     fmt.Println("  aigit status                     # show last checkpoint summary + diff")
     fmt.Println("  aigit id                         # show your remote user id and refs")
-    fmt.Println("  aigit list [-n 20] [--meta]      # list recent checkpoints for this branch")
-    fmt.Println("  aigit restore <sha>              # restore files from a checkpoint")
+    fmt.Println("  aigit list [-n 20] [--meta] [--worktree]  # list recent checkpoints (--worktree: every worktree)")
+    fmt.Println("  aigit restore [--exact] [--staged] <sha> [-- paths]  # restore files (--exact removes extras, --staged the index)")
+    fmt.Println("  aigit restore --before <time>    # restore how it was then (20m, yesterday, 2026-10-17 14:00)")
+    fmt.Println("  aigit log [--live|--user id] [--json] <path>    # checkpoints that changed a file, with diffstat")
+    fmt.Println("  aigit blame [--live|--user id] [--json] <path>  # attribute each line to a checkpoint and user")
+    fmt.Println("  aigit search <text> | -S <str> | -G <re> [--json]  # find checkpoints (local, live, teammates)")
+    fmt.Println("  aigit tag <sha> <name>           # name a checkpoint (or: checkpoint -t <name>)")
+    fmt.Println("  aigit gc [--dry-run]             # thin checkpoint/live chains per aigit.keep.* policy")
+    fmt.Println("  aigit stash <sha>                # turn a checkpoint into a git stash entry")
+    fmt.Println("  aigit bisect start <good> <bad>  # then: aigit bisect run <cmd> (scratch worktree)")
+    fmt.Println("  aigit undo [--list [--json]]     # roll back the last restore/apply (safety snapshots)")
+    fmt.Println("  aigit diff [<a>] [<b>] [--stat|--json]  # compare checkpoints, live~N, ck@{10m}, user:<id>, worktree")
+    fmt.Println("  aigit publish [--since <sha>|--last N]  # squash checkpoints into a commit on the branch")
     fmt.Println("  aigit sync pull [options]        # fetch checkpoint refs via remote (manual)")
     fmt.Println("  aigit remote-list [--user id]    # list users or a user's remote checkpoints")
     fmt.Println("  aigit apply --from <user>        # apply a remote user's checkpoint to worktree")
@@ -214,10 +416,26 @@ func printHelp() {
     fmt.Println("AI summaries (OpenRouter): set OPENROUTER_API_KEY, default model openai/gpt-oss-20b:free")
     fmt.Println("")
     fmt.Println("Tips:")
-    fmt.Println("  git log --oneline $(git rev-parse --abbrev-ref HEAD | xargs -I{} echo refs/aigit/checkpoints/{})")
+    fmt.Println("  git log --oneline refs/aigit/checkpoints/<branch>  # a / in the branch name is written %2F")
     fmt.Println("  git show <sha>")
 }
 
+// parseArgs parses fs allowing flags after positional arguments
+// (`aigit restore <sha> --exact`). Arguments after "--" are returned
+// separately as paths.
+func parseArgs(fs *flag.FlagSet, args []string) (pos, paths []string, err error) {
+    for {
+        if err := fs.Parse(args); err != nil { return nil, nil, err }
+        rest := fs.Args()
+        if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+            return pos, rest, nil
+        }
+        if len(rest) == 0 { return pos, nil, nil }
+        pos = append(pos, rest[0])
+        args = rest[1:]
+    }
+}
+
 func fatal(err error) {
     fmt.Fprintf(os.Stderr, "aigit: %v\n", err)
     os.Exit(1)
@@ -226,7 +444,7 @@ func fatal(err error) {
 // ---- Core helpers ----
 
 func git(args ...string) (string, error) {
-    cmd := exec.Command("git", args...)
+    cmd := gitCommand(args...)
     var out bytes.Buffer
     var stderr bytes.Buffer
     cmd.Stdout = &out
@@ -240,8 +458,20 @@ func git(args ...string) (string, error) {
     return strings.TrimSpace(out.String()), nil
 }
 
+// gitBytes is git without trimming, for blob contents that must round-trip.
+func gitBytes(args ...string) ([]byte, error) {
+    cmd := gitCommand(args...)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return nil, fmt.Errorf("git %v: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+    }
+    return out, nil
+}
+
 func gitEnv(env map[string]string, args ...string) (string, error) {
-    cmd := exec.Command("git", args...)
+    cmd := gitCommand(args...)
     cmd.Env = os.Environ()
     for k, v := range env {
         cmd.Env = append(cmd.Env, k+"="+v)
@@ -259,12 +489,64 @@ func gitEnv(env map[string]string, args ...string) (string, error) {
     return strings.TrimSpace(out.String()), nil
 }
 
-func currentBranch() (string, error) {
-    s, err := git("rev-parse", "--abbrev-ref", "HEAD")
-    if err != nil {
-        return "", err
+// gitInput runs git with the given string on stdin (e.g. commit-tree messages).
+func gitInput(stdin string, args ...string) (string, error) {
+    return gitEnvInput(nil, stdin, args...)
+}
+
+// gitEnvInput is gitInput with extra environment variables.
+func gitEnvInput(env map[string]string, stdin string, args ...string) (string, error) {
+    cmd := gitCommand(args...)
+    if len(env) > 0 {
+        cmd.Env = os.Environ()
+        for k, v := range env {
+            cmd.Env = append(cmd.Env, k+"="+v)
+        }
+    }
+    cmd.Stdin = strings.NewReader(stdin)
+    var out bytes.Buffer
+    var stderr bytes.Buffer
+    cmd.Stdout = &out
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        if stderr.Len() > 0 {
+            return "", fmt.Errorf("git %v: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+        }
+        return "", fmt.Errorf("git %v: %w", strings.Join(args, " "), err)
     }
-    return s, nil
+    return strings.TrimSpace(out.String()), nil
+}
+
+// currentBranch returns the name aigit refs are keyed on: the checked-out
+// branch (including an unborn one), the branch being rebased, or
+// detached-<sha> for a detached HEAD so unrelated detached sessions never
+// share a chain.
+func currentBranch() (string, error) {
+    if br, ok := headBranch(); ok { return br, nil }
+    if s, err := git("symbolic-ref", "-q", "HEAD"); err == nil && strings.HasPrefix(s, "refs/heads/") {
+        return strings.TrimPrefix(s, "refs/heads/"), nil
+    }
+    if br := rebasingBranch(); br != "" { return br, nil }
+    sha, err := revParse("HEAD^{commit}")
+    if err != nil { return "", errors.New("HEAD is neither a branch nor a commit") }
+    return detachedPrefix + sha, nil
+}
+
+// refBranch turns branch into a single ref component by escaping "%" and
+// "/", so the chains of feature and feature/x, or the tags of a and of a/b,
+// never run into git's directory/file ref conflicts. Branches without
+// slashes keep their plain names.
+func refBranch(branch string) string {
+    return strings.NewReplacer("%", "%25", "/", "%2F").Replace(branch)
+}
+
+// detachedPrefix marks the ref namespace of a detached HEAD. Branch names
+// may contain it, but a full 40-hex suffix makes a clash practically impossible
+// and, unlike detached/<sha>, it cannot conflict with a branch named "detached".
+const detachedPrefix = "detached-"
+
+func isDetached(branch string) bool {
+    return strings.HasPrefix(branch, detachedPrefix) && len(branch) == len(detachedPrefix)+40 && isHex(branch[len(detachedPrefix):])
 }
 
 func ckRef() (string, error) {
@@ -272,14 +554,16 @@ func ckRef() (string, error) {
     if err != nil {
         return "", err
     }
-    return "refs/aigit/checkpoints/" + br, nil
+    return refRoot() + "checkpoints/" + refBranch(br), nil
 }
 
 func gitDir() (string, error) {
-    return git("rev-parse", "--git-dir")
+    if p, err := repoInfo(); err == nil { return p.GitDir, nil }
+    return git("rev-parse", "--absolute-git-dir")
 }
 
 func gitTopLevel() (string, error) {
+    if p, err := repoInfo(); err == nil { return p.Top, nil }
     return git("rev-parse", "--show-toplevel")
 }
 
@@ -294,11 +578,17 @@ func isMerging() bool {
 
 // ---- Commands ----
 
-func doCheckpoint(summary string) error {
+// doCheckpoint writes a manual checkpoint. With paths, only the matching
+// files are taken from the worktree (see snapshotOptions.Paths).
+func doCheckpoint(summary string, paths ...string) error {
     // Write snapshot to checkpoint ref (manual share only)
     ref, err := ckRef()
     if err != nil { return err }
-    newSha, err := writeSnapshotToRef(summary, ref)
+    newSha, err := writeSnapshotToRef(summary, ref, snapshotOptions{Kind: "manual", SummarySource: "manual", Paths: paths})
+    if errors.Is(err, errNoChanges) {
+        if !quietEcho { fmt.Printf("Nothing changed since checkpoint %s; no new checkpoint.\n", short(newSha)) }
+        return nil
+    }
     if err != nil { return err }
     if !quietEcho {
         fmt.Printf("update-arrived!\n")
@@ -307,22 +597,8 @@ func doCheckpoint(summary string) error {
     logLine("update-arrived!")
     logLine("Summary: %s", summary)
     // Print a concise list of changed files for this checkpoint
-    if files, err := git("diff-tree", "--no-commit-id", "--name-status", "-r", newSha); err == nil && strings.TrimSpace(files) != "" {
-        if !quietEcho { fmt.Println("Files:") }
-        logLine("Files:")
-        scanner := bufio.NewScanner(strings.NewReader(files))
-        count := 0
-        for scanner.Scan() {
-            line := scanner.Text()
-            if !quietEcho { fmt.Printf("  %s\n", line) }
-            logLine("  %s", line)
-            count++
-            if count >= 20 {
-                if !quietEcho { fmt.Println("  ...") }
-                logLine("  ...")
-                break
-            }
-        }
+    if files, err := git("diff-tree", "--no-commit-id", "--name-status", "-r", newSha); err == nil {
+        echoFiles(parseNameStatus(files), !quietEcho, true)
     }
     if !quietEcho { fmt.Printf("Checkpoint: %s  (%s)\n", newSha, summary) }
     logLine("Checkpoint: %s  (%s)", newSha, summary)
@@ -330,56 +606,363 @@ func doCheckpoint(summary string) error {
     return nil
 }
 
+// snapshotOptions describes where a snapshot came from; it ends up in the
+// commit's Aigit-* trailers.
+type snapshotOptions struct {
+    Kind          string // manual|live|undo|stash
+    SummarySource string // manual|ai|diff|off|aigit|stash
+    Model         string // AI model, when SummarySource is ai
+    // Imported snapshots (checkpoint --from-stash) bring their own tree, base
+    // commit and index tree instead of reading the worktree.
+    Tree, Base, Index string
+    Stash             string // the stash commit it was imported from
+    // Paths scopes the snapshot: matching files come from the worktree, the
+    // rest is carried over from the previous snapshot (Aigit-Scope trailer).
+    Paths []string
+    // Changed lists the paths (relative to the top level) the watcher saw
+    // change; only those are rescanned. nil rescans everything.
+    Changed []string
+}
+
 // writeSnapshotToRef snapshots the working tree and updates targetRef to a new commit.
-func writeSnapshotToRef(summary, targetRef string) (string, error) {
-    // Create a temp dir and point GIT_INDEX_FILE to a path inside it.
-    tmpdir, err := os.MkdirTemp("", "aigit-index-*")
-    if err != nil { return "", err }
-    defer os.RemoveAll(tmpdir)
-    idxPath := filepath.Join(tmpdir, "index")
-    env := map[string]string{"GIT_INDEX_FILE": idxPath}
-    if _, err := gitEnv(env, "add", "-A"); err != nil { return "", err }
-    tree, err := gitEnv(env, "write-tree")
+func writeSnapshotToRef(summary, targetRef string, opts snapshotOptions) (string, error) {
+    // One writer at a time per repository (see lock.go)
+    unlock, err := lockRepo()
     if err != nil { return "", err }
-
+    defer unlock()
+    imported := opts.Tree != ""
     // Parent is last commit on targetRef if exists
     var parent string
-    if out, err := git("rev-parse", "-q", "--verify", targetRef+"^{commit}"); err == nil { parent = out }
+    if out, err := revParse(targetRef+"^{commit}"); err == nil { parent = out }
+
+    tree := opts.Tree
+    var scope []string
+    if len(opts.Paths) > 0 && !imported {
+        from := parent
+        if from == "" { from, _ = revParse("HEAD^{tree}") }
+        if tree, err = scopedSnapshotTree(from, opts.Paths); err != nil { return "", err }
+        if scope, err = topPaths(opts.Paths); err != nil { return "", err }
+    } else if !imported {
+        if tree, err = snapshotTreeOf(opts.Changed); err != nil { return "", err }
+    }
+    // Everything else the snapshot records comes first, so an unchanged
+    // worktree is noticed before anything is written. Undo entries are
+    // always written: each marks an operation.
+    var idx, subs string
+    if !imported {
+        // The staging area is unavailable while the index has conflicts
+        idx, _ = indexTree()
+        // Work inside submodules goes to their own chains (see submodule.go)
+        if len(scope) == 0 {
+            if subs, err = snapshotSubmodules(summary, targetRef, opts); err != nil { return "", err }
+        }
+        if parent != "" && opts.Kind != "undo" && currentOp() == "" && sameSnapshot(parent, tree, idx, subs) {
+            return parent, errNoChanges
+        }
+    }
 
-    base, err := git("rev-parse", "HEAD")
-    if err != nil { base = "0000000000000000000000000000000000000000" }
+    base := opts.Base
+    if !imported {
+        if base, err = revParse("HEAD"); err != nil { base = "0000000000000000000000000000000000000000" }
+    }
     merging := "no"
-    if isMerging() { merging = "yes" }
+    if !imported && isMerging() { merging = "yes" }
 
     meta := fmt.Sprintf("Aigit-Base: %s\nAigit-When: %s\nAigit-Merge: %s\n", base, time.Now().UTC().Format(time.RFC3339), merging)
+    host, _ := os.Hostname()
+    meta += fmt.Sprintf("Aigit-User: %s\nAigit-Host: %s\nAigit-Kind: %s\nAigit-Summary-Source: %s\n", getUserID(), defaultStr(host, "unknown"), opts.Kind, opts.SummarySource)
+    if opts.Model != "" { meta += fmt.Sprintf("Aigit-Model: %s\n", opts.Model) }
+    if wt := worktreeName(); wt != "" { meta += fmt.Sprintf("Aigit-Worktree: %s\n", wt) }
+    // One trailer per path, so commas and spaces in paths survive
+    for _, p := range scope {
+        meta += fmt.Sprintf("Aigit-Scope: %s\n", quoteTrailer(p))
+    }
+    // Trailers after the size of the change, which depends on the parent
+    var rest string
+    // The staging area, so restore --staged can bring back the staged/unstaged
+    // split. The tree itself is kept reachable on the index chain.
+    if imported { idx = opts.Index }
+    if idx != "" {
+        br, err := currentBranch()
+        if err != nil { return "", err }
+        if err := recordIndex(br, idx); err != nil { return "", fmt.Errorf("recording the staging area: %w", err) }
+        rest += fmt.Sprintf("Aigit-Index: %s\n", idx)
+    }
+    if imported && opts.Stash != "" { rest += fmt.Sprintf("Aigit-Stash: %s\n", opts.Stash) }
+    // A merge/rebase in progress is recorded on the state chain (see opstate.go)
+    if op := currentOp(); op != "" && !imported {
+        state, err := writeOpState(op)
+        if err != nil { return "", fmt.Errorf("recording %s state: %w", op, err) }
+        rest += fmt.Sprintf("Aigit-Op: %s\nAigit-State: %s\n", op, state)
+        if conflicts, _ := listConflicts(); len(conflicts) > 0 {
+            for _, c := range conflicts {
+                rest += fmt.Sprintf("Aigit-Conflicts: %s\n", quoteTrailer(c))
+            }
+        }
+    }
+    rest += subs
 
-    // Build commit via commit-tree
-    var newSha string
-    {
+    first := parent
+    return updateChain(targetRef, parent, summary, func(parent string) (string, error) {
+        // Re-parented onto a tip another writer just made: it may hold this state already
+        if parent != first && !imported && opts.Kind != "undo" && sameSnapshot(parent, tree, idx, subs) {
+            return "", errNoChanges
+        }
+        // Size of the change relative to the previous snapshot (or HEAD for the first one)
+        stats := ""
+        from := parent
+        if from == "" && strings.Trim(base, "0") != "" { from = base }
+        if from == "" { from = emptyTree }
+        if files, ins, del, err := diffStats(from, tree); err == nil {
+            stats = fmt.Sprintf("Aigit-Files: %d\nAigit-Insertions: %d\nAigit-Deletions: %d\n", files, ins, del)
+        }
         args := []string{"commit-tree", tree}
         if parent != "" { args = append(args, "-p", parent) }
-        cmd := exec.Command("git", args...)
-        cmd.Stdin = strings.NewReader(summary + "\n\n" + meta + "\n")
-        var out bytes.Buffer
-        var stderr bytes.Buffer
-        cmd.Stdout = &out
-        cmd.Stderr = &stderr
-        if err := cmd.Run(); err != nil {
-            if stderr.Len() > 0 {
-                return "", fmt.Errorf("git %v: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+        return gitInput(summary+"\n\n"+meta+stats+rest+"\n", args...)
+    })
+}
+
+// casAttempts bounds how often a snapshot is re-parented onto a chain tip
+// that moved under it.
+const casAttempts = 5
+
+// updateChain commits a snapshot with build(parent) and moves ref to it only
+// if the tip is still parent (an empty parent means ref must not exist). If
+// another writer got there first, e.g. from another worktree that does not
+// share the lock, the snapshot is rebuilt on the new tip and tried again.
+func updateChain(ref, parent, summary string, build func(parent string) (string, error)) (string, error) {
+    for attempt := 1; ; attempt++ {
+        sha, err := build(parent)
+        if errors.Is(err, errNoChanges) { return parent, err }
+        if err != nil { return "", err }
+        _, err = git("update-ref", "-m", "aigit: "+summary, ref, sha, parent)
+        if err == nil { return sha, nil }
+        tip, _ := revParse(ref+"^{commit}")
+        if tip == parent { return "", err }
+        if attempt == casAttempts {
+            return "", fmt.Errorf("%s kept moving while the snapshot was written (%d attempts); try again", ref, attempt)
+        }
+        parent = tip
+    }
+}
+
+// errNoChanges is returned by writeSnapshotToRef, with the current tip, when
+// the snapshot would be identical to it.
+var errNoChanges = errors.New("nothing changed since the last snapshot")
+
+// sameSnapshot reports whether snapshot sha already records this tree,
+// staging area and submodule state, with no operation in progress.
+func sameSnapshot(sha, tree, idx, subs string) bool {
+    t, body, err := readCommit(sha)
+    if err != nil || t != tree { return false }
+    m := parseMeta(body)
+    if m.Trailers["Aigit-Op"] != "" || m.Index != idx { return false }
+    var recorded strings.Builder
+    for _, line := range strings.Split(body, "\n") {
+        if strings.HasPrefix(line, "Aigit-Submodule: ") { recorded.WriteString(line + "\n") }
+    }
+    return recorded.String() == subs
+}
+
+// diffStats counts changed files and inserted/deleted lines between two tree-ishes.
+func diffStats(from, to string) (files, insertions, deletions int, err error) {
+    out, err := git("diff", "--numstat", "--no-renames", from, to)
+    if err != nil { return 0, 0, 0, err }
+    for _, line := range strings.Split(out, "\n") {
+        parts := strings.SplitN(line, "\t", 3)
+        if len(parts) < 3 { continue }
+        files++
+        // Binary files report "-"
+        if n, err := strconv.Atoi(parts[0]); err == nil { insertions += n }
+        if n, err := strconv.Atoi(parts[1]); err == nil { deletions += n }
+    }
+    return files, insertions, deletions, nil
+}
+
+// snapshotTree writes the working tree (tracked and untracked, honoring
+// .gitignore) as a tree object without touching the user's index.
+func snapshotTree() (string, error) {
+    return snapshotTreeOf(nil)
+}
+
+// snapshotTreeOf is snapshotTree that only rescans the changed paths
+// (relative to the top level) unless changed is nil. It keeps a private
+// index in aigitDir between snapshots, so git's stat cache skips files that
+// did not change instead of rehashing the whole worktree. If that index is
+// busy (another aigit process) or unusable, it falls back to a throwaway one.
+func snapshotTreeOf(changed []string) (string, error) {
+    dir, err := aigitDir()
+    if err != nil { return snapshotTreeFresh() }
+    idx, err := filepath.Abs(filepath.Join(dir, "index"))
+    if err != nil { return snapshotTreeFresh() }
+    env := map[string]string{"GIT_INDEX_FILE": idx}
+    if _, err := os.Stat(idx); err != nil { changed = nil }
+    if changed != nil {
+        specs, err := changedPathspecs(changed)
+        if err == nil && specs != nil {
+            // git add refuses ignored pathspecs, so leave them out
+            if specs, err = dropIgnored(env, specs); err == nil {
+                if len(specs) == 0 { return gitEnv(env, "write-tree") }
+                if _, err := gitEnv(env, append([]string{"add", "-A", "--"}, specs...)...); err == nil {
+                    return gitEnv(env, "write-tree")
+                }
             }
-            return "", fmt.Errorf("git %v: %w", strings.Join(args, " "), err)
         }
-        newSha = strings.TrimSpace(out.String())
     }
+    stamp := scanStamp(idx)
+    if added, err := gitEnv(env, "add", "-A", "-v"); err == nil {
+        if tree, ok := lastScanTree(idx, stamp, added); ok { return tree, nil }
+        // Entries the private index kept from before a .gitignore change
+        // would never be dropped by add -A; a fresh index would not have them
+        top, err := gitTopLevel()
+        var ignored string
+        if err == nil { ignored, err = gitEnv(env, "-C", top, "ls-files", "-z", "-c", "-i", "--exclude-standard") }
+        if err == nil && ignored != "" {
+            _, err = gitEnvInput(env, ignored, "-C", top, "update-index", "-z", "--force-remove", "--stdin")
+        }
+        if err == nil {
+            tree, err := gitEnv(env, "write-tree")
+            if err == nil { rememberScan(idx, tree) }
+            return tree, err
+        }
+    }
+    if _, err := os.Stat(idx + ".lock"); err != nil {
+        // Not busy, so the index itself is bad: start over next time
+        _ = os.Remove(idx)
+    }
+    return snapshotTreeFresh()
+}
 
-    // Atomic update-ref
-    if parent != "" {
-        if _, err := git("update-ref", "-m", fmt.Sprintf("aigit: %s", summary), targetRef, newSha, parent); err != nil { return "", err }
-    } else {
-        if _, err := git("update-ref", "-m", fmt.Sprintf("aigit: %s", summary), targetRef, newSha); err != nil { return "", err }
+// snapshotTreeFresh hashes the whole worktree into a throwaway index.
+func snapshotTreeFresh() (string, error) {
+    // Create a temp dir and point GIT_INDEX_FILE to a path inside it.
+    tmpdir, err := os.MkdirTemp("", "aigit-index-*")
+    if err != nil { return "", err }
+    defer os.RemoveAll(tmpdir)
+    idxPath := filepath.Join(tmpdir, "index")
+    env := map[string]string{"GIT_INDEX_FILE": idxPath}
+    if _, err := gitEnv(env, "add", "-A"); err != nil { return "", err }
+    return gitEnv(env, "write-tree")
+}
+
+// dropIgnored removes the changedPathspecs entries that .gitignore excludes
+// (and that are not tracked in the index named by env). check-ignore takes
+// plain paths, so it runs at the top level without the pathspec magic.
+func dropIgnored(env map[string]string, specs []string) ([]string, error) {
+    if len(specs) == 0 { return specs, nil }
+    top, err := gitTopLevel()
+    if err != nil { return nil, err }
+    var in strings.Builder
+    for _, s := range specs {
+        in.WriteString(strings.TrimPrefix(s, ":(top,literal)") + "\x00")
+    }
+    out, err := gitEnvInput(env, in.String(), "-C", top, "check-ignore", "-z", "--stdin")
+    var exitErr *exec.ExitError
+    // Exit status 1: none of them is ignored
+    if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 { return specs, nil }
+    if err != nil { return nil, err }
+    ignored := map[string]bool{}
+    for _, p := range splitNul(out) { ignored[p] = true }
+    kept := []string{}
+    for _, s := range specs {
+        if !ignored[strings.TrimPrefix(s, ":(top,literal)")] { kept = append(kept, s) }
+    }
+    return kept, nil
+}
+
+// changedPathspecs turns watcher paths into pathspecs for git add -A. A path
+// that no longer exists is replaced by its nearest existing parent, since
+// git rejects pathspecs that match nothing. It returns nil when that parent
+// is the top level (rescan everything).
+func changedPathspecs(changed []string) ([]string, error) {
+    top, err := gitTopLevel()
+    if err != nil { return nil, err }
+    seen := map[string]bool{}
+    specs := []string{}
+    for _, p := range changed {
+        for p != "." && p != "" {
+            if _, err := os.Lstat(filepath.Join(top, filepath.FromSlash(p))); err == nil { break }
+            p = path.Dir(p)
+        }
+        if p == "." || p == "" { return nil, nil }
+        if seen[p] { continue }
+        seen[p] = true
+        specs = append(specs, ":(top,literal)"+p)
+    }
+    return specs, nil
+}
+
+// scopedSnapshotTree is snapshotTree limited to paths: everything else is
+// taken from the tree-ish base (the previous snapshot), or left out when
+// base is empty.
+func scopedSnapshotTree(base string, paths []string) (string, error) {
+    tmpdir, err := os.MkdirTemp("", "aigit-index-*")
+    if err != nil { return "", err }
+    defer os.RemoveAll(tmpdir)
+    env := map[string]string{"GIT_INDEX_FILE": filepath.Join(tmpdir, "index")}
+    if base != "" {
+        if _, err := gitEnv(env, "read-tree", base); err != nil { return "", err }
+    }
+    if _, err := gitEnv(env, append([]string{"add", "-A", "--"}, paths...)...); err != nil { return "", err }
+    return gitEnv(env, "write-tree")
+}
+
+// topPaths rewrites cwd-relative pathspecs relative to the top level, as
+// recorded in Aigit-Scope. Magic pathspecs (":...") are kept as given.
+func topPaths(paths []string) ([]string, error) {
+    prefix, err := git("rev-parse", "--show-prefix")
+    if err != nil { return nil, err }
+    var out []string
+    for _, p := range paths {
+        if strings.HasPrefix(p, ":") {
+            out = append(out, p)
+            continue
+        }
+        out = append(out, path.Join(prefix, filepath.ToSlash(p)))
     }
-    return newSha, nil
+    return out, nil
+}
+
+// indexRef is the chain that keeps the trees named by Aigit-Index trailers
+// reachable, so gc keeps them and push/fetch carry them along.
+func indexRef(branch string) string {
+    return refRoot() + "index/" + refBranch(branch)
+}
+
+func userIndexRemoteRef(user, branch string) string {
+    return "refs/aigit/users/" + user + "/index/" + refBranch(branch)
+}
+
+// recordIndex commits staging-area tree idx onto the branch's index chain,
+// unless the tip already holds it (the staging area rarely changes).
+func recordIndex(branch, idx string) error {
+    ref := indexRef(branch)
+    prev, _ := revParse(ref + "^{commit}")
+    args := []string{"commit-tree", idx}
+    if prev != "" {
+        if tree, _ := revParse(prev + "^{tree}"); tree == idx { return nil }
+        args = append(args, "-p", prev)
+    }
+    sha, err := gitInput("aigit index\n", args...)
+    if err != nil { return err }
+    _, err = git("update-ref", "-m", "aigit: index", ref, sha, prev)
+    return err
+}
+
+// indexTree writes the user's staging area as a tree object. It works on a
+// copy of the index so the real one is never locked or rewritten.
+func indexTree() (string, error) {
+    real, err := git("rev-parse", "--path-format=absolute", "--git-path", "index")
+    if err != nil { return "", err }
+    tmpdir, err := os.MkdirTemp("", "aigit-index-*")
+    if err != nil { return "", err }
+    defer os.RemoveAll(tmpdir)
+    idxPath := filepath.Join(tmpdir, "index")
+    if b, err := os.ReadFile(real); err == nil {
+        if err := os.WriteFile(idxPath, b, 0o644); err != nil { return "", err }
+    }
+    // A missing index (fresh repo) writes the empty tree
+    return gitEnv(map[string]string{"GIT_INDEX_FILE": idxPath}, "write-tree")
 }
 
 func doStatus() error {
@@ -422,16 +1005,41 @@ func doStatus() error {
     return nil
 }
 
-func doRestore(sha string) error {
-    fmt.Printf("Restoring worktree from %s (does not move HEAD)...\n", sha)
-    // Prefer git restore, fallback to checkout for older Git
-    if _, err := git("restore", "--worktree", "--source", sha, "--", "."); err != nil {
-        // Fallback
-        if _, err2 := git("checkout", sha, "--", "."); err2 != nil {
-            return fmt.Errorf("restore failed: %v; fallback checkout failed: %v", err, err2)
+func doRestore(spec string, opts restoreOptions) error {
+    r, err := resolveRev(spec)
+    if err != nil { return err }
+    if r.Worktree { return errors.New("cannot restore from the worktree") }
+    sha := r.Commit
+    st, err := prepareWithState(sha, &opts)
+    if err != nil { return err }
+    if err := applyScope(sha, &opts); err != nil { return err }
+    if st != nil {
+        fmt.Printf("Restoring worktree and %s state from %s...\n", st.Op, sha)
+    } else {
+        fmt.Printf("Restoring worktree from %s (does not move HEAD)...\n", sha)
+    }
+    cause := "restore " + short(sha)
+    if len(opts.Paths) > 0 { cause += " -- " + strings.Join(opts.Paths, " ") }
+    before, err := saveUndo(cause)
+    if err != nil { return err }
+    opts.Before = before
+    touched, err := restoreWorktree(sha, opts)
+    if err != nil { return err }
+    echoFiles(touched, true, false)
+    if st != nil { return finishWithState(st) }
+    if opts.Staged {
+        if err := restoreIndex(sha, opts); err != nil { return err }
+        fmt.Println("Staging area restored.")
+    }
+    if opts.Exact {
+        removed := 0
+        for _, c := range touched {
+            if c.Status == "D" { removed++ }
         }
+        fmt.Printf("Done. Worktree mirrors %s (%d files removed; ignored files left as-is).\n", short(sha), removed)
+        return nil
     }
-    fmt.Println("Done. (Untracked files are left as-is.)")
+    fmt.Println("Done. (Untracked files are left as-is; 'aigit undo' reverts this restore.)")
     return nil
 }
 
@@ -447,7 +1055,8 @@ func doWatch(interval, settle time.Duration, summaryMode, aiModel string) error
 
     // Start fsnotify-based watcher in a goroutine
     events := make(chan struct{}, 1)
-    stop, err := startFsWatch(root, events)
+    fsChanges = newPathSet()
+    stop, err := startFsWatch(root, events, fsChanges)
     if err != nil {
         fmt.Fprintf(os.Stderr, "fsnotify unavailable, falling back to timer-only: %v\n", err)
     }
@@ -465,7 +1074,9 @@ func doWatch(interval, settle time.Duration, summaryMode, aiModel string) error
     defer idleTimer.Stop()
 
     var lastEvent time.Time
+    var lastGC time.Time
     active := false
+    autoGC := !strings.EqualFold(strings.TrimSpace(getGitConfig("aigit.gc")), "off")
 
     for {
         select {
@@ -489,11 +1100,20 @@ func doWatch(interval, settle time.Duration, summaryMode, aiModel string) error
             if err := maybePullAndAutoApply(); err != nil {
                 fmt.Fprintf(os.Stderr, "remote sync/apply failed: %v\n", err)
             }
+            // Apply the retention policy at most once an hour
+            if autoGC && time.Since(lastGC) >= time.Hour {
+                lastGC = time.Now()
+                if err := doGC(false, true); err != nil {
+                    fmt.Fprintf(os.Stderr, "gc failed: %v\n", err)
+                }
+            }
             if !active {
                 // Stay idle until the first save enables local checkpointing
                 continue
             }
-            // periodic safety net for local changes
+            // periodic safety net for local changes, including those fsnotify
+            // does not report (hidden dirs, .gitignore edits): rescan everything
+            fsChanges.markAll()
             if err := maybeCheckpoint(summaryMode, aiModel); err != nil {
                 fmt.Fprintf(os.Stderr, "checkpoint error: %v\n", err)
             }
@@ -510,6 +1130,17 @@ func maybeCheckpoint(summaryMode, aiModel string) error {
         // Recently applied from remote; skip to avoid ping-pong
         return nil
     }
+    // After a branch switch, let the checkout settle for a round instead of
+    // snapshotting a half-switched worktree onto the new branch's chain
+    if br, err := currentBranch(); err == nil {
+        prev := watchedBranch
+        watchedBranch = br
+        if prev != "" && prev != br {
+            fmt.Printf("Switched %s -> %s; live snapshots now go to %s\n", prev, br, liveLocalRef(br))
+            logLine("Switched %s -> %s", prev, br)
+            return nil
+        }
+    }
     changed, err := workingTreeChanged()
     if err != nil {
         return err
@@ -561,29 +1192,22 @@ func maybeCheckpoint(summaryMode, aiModel string) error {
     // Live snapshot: update live ref and push to remote if configured/default is available
     br, _ := currentBranch()
     target := liveLocalRef(br)
-    newSha, err := writeSnapshotToRef(summary, target)
-    if err != nil { return err }
+    opts := snapshotOptions{Kind: "live", SummarySource: strings.ToLower(used)}
+    if used == "AI" { opts.Model = aiModel }
+    if fsChanges != nil { opts.Changed = fsChanges.take() }
+    newSha, err := writeSnapshotToRef(summary, target, opts)
+    if errors.Is(err, errNoChanges) { return nil }
+    if err != nil {
+        if fsChanges != nil { fsChanges.markAll() }
+        return err
+    }
 
     fmt.Printf("update-arrived!\n")
     fmt.Printf("Summary: %s\n", summary)
     logLine("update-arrived!")
     logLine("Summary: %s", summary)
-    if files, err := git("diff-tree", "--no-commit-id", "--name-status", "-r", newSha); err == nil && strings.TrimSpace(files) != "" {
-        fmt.Println("Files:")
-        logLine("Files:")
-        scanner := bufio.NewScanner(strings.NewReader(files))
-        count := 0
-        for scanner.Scan() {
-            line := scanner.Text()
-            fmt.Printf("  %s\n", line)
-            logLine("  %s", line)
-            count++
-            if count >= 20 {
-                fmt.Println("  ...")
-                logLine("  ...")
-                break
-            }
-        }
+    if files, err := git("diff-tree", "--no-commit-id", "--name-status", "-r", newSha); err == nil {
+        echoFiles(parseNameStatus(files), true, true)
     }
     fmt.Printf("Live: %s  (%s)\n", newSha, summary)
     logLine("Live: %s  (%s)", newSha, summary)
@@ -599,12 +1223,30 @@ func maybeCheckpoint(summaryMode, aiModel string) error {
     return nil
 }
 
+// workingTreeChanged reports whether the worktree differs from the last live
+// snapshot (or from HEAD before the first one). Saves that only touched
+// timestamps, or files that match what auto-apply just brought in, do not
+// count.
 func workingTreeChanged() (bool, error) {
-    out, err := git("status", "--porcelain")
+    var changed []string
+    if fsChanges != nil { changed = fsChanges.take() }
+    tree, err := snapshotTreeOf(changed)
     if err != nil {
+        if fsChanges != nil { fsChanges.markAll() }
         return false, err
     }
-    return strings.TrimSpace(out) != "", nil
+    if tree == appliedTree { return false, nil }
+    br, err := currentBranch()
+    if err != nil { return false, err }
+    return tree != lastLiveTree(br), nil
+}
+
+// lastLiveTree is the tree of the last live snapshot on branch, or of HEAD
+// before the first one.
+func lastLiveTree(branch string) string {
+    if tree, err := revParse(liveLocalRef(branch) + "^{tree}"); err == nil { return tree }
+    if tree, err := revParse("HEAD^{tree}"); err == nil { return tree }
+    return emptyTree
 }
 
 func diffOneLiner() (string, error) {
@@ -612,6 +1254,22 @@ func diffOneLiner() (string, error) {
     if err != nil {
         return "", err
     }
+    // Include untracked files as adds
+    var untracked []string
+    if outU, err := git("ls-files", "--others", "--exclude-standard"); err == nil {
+        for _, ln := range strings.Split(strings.TrimSpace(outU), "\n") {
+            ln = strings.TrimSpace(ln)
+            if ln != "" {
+                untracked = append(untracked, ln)
+            }
+        }
+    }
+    return nameStatusOneLiner(out, untracked), nil
+}
+
+// nameStatusOneLiner turns `git diff --name-status` output into a short
+// "Edit a; Add b" style summary. extraAdds are reported as additions.
+func nameStatusOneLiner(out string, extraAdds []string) string {
     var adds, mods, dels, renames []string
     scanner := bufio.NewScanner(strings.NewReader(out))
     for scanner.Scan() {
@@ -632,15 +1290,7 @@ func diffOneLiner() (string, error) {
             if len(parts) > 2 { renames = append(renames, parts[1]+"->"+parts[2]) }
         }
     }
-    // Include untracked files as adds
-    if outU, err := git("ls-files", "--others", "--exclude-standard"); err == nil {
-        for _, ln := range strings.Split(strings.TrimSpace(outU), "\n") {
-            ln = strings.TrimSpace(ln)
-            if ln != "" {
-                adds = append(adds, ln)
-            }
-        }
-    }
+    adds = append(adds, extraAdds...)
     var chunks []string
     if len(mods) > 0 {
         chunks = append(chunks, fmt.Sprintf("Edit %s", joinPreview(mods)))
@@ -654,7 +1304,7 @@ func diffOneLiner() (string, error) {
     if len(renames) > 0 {
         chunks = append(chunks, fmt.Sprintf("Rename %s", joinPreview(renames)))
     }
-    return strings.Join(chunks, "; "), nil
+    return strings.Join(chunks, "; ")
 }
 
 func joinPreview(paths []string) string {
@@ -778,7 +1428,9 @@ func selfPath() string {
     return p
 }
 
-func doEvents(sessionID string, back int, follow bool) error {
+// doEvents prints new log lines for a session. With asJSON each line is
+// emitted as one NDJSON record (see eventJSON).
+func doEvents(sessionID string, back int, follow, asJSON bool) error {
     dir, err := aigitDir()
     if err != nil { return err }
     logp := filepath.Join(dir, "aigit.log")
@@ -812,7 +1464,10 @@ func doEvents(sessionID string, back int, follow bool) error {
             if back > 0 && len(lines) > back {
                 lines = lines[len(lines)-back:]
             }
-            for _, ln := range lines { if strings.TrimSpace(ln) != "" { fmt.Println(ln) } }
+            for _, ln := range lines {
+                if asJSON { printEventJSON(ln); continue }
+                if strings.TrimSpace(ln) != "" { fmt.Println(ln) }
+            }
             // Advance to end and return
             _ = os.WriteFile(spos, []byte(fmt.Sprint(size)), 0o644)
             return nil
@@ -827,7 +1482,17 @@ func doEvents(sessionID string, back int, follow bool) error {
         f, err := os.Open(logp)
         if err != nil { time.Sleep(500 * time.Millisecond); continue }
         if pos > 0 { if _, err := f.Seek(pos, io.SeekStart); err != nil { pos = 0; f.Seek(0, io.SeekStart) } }
-        n, _ := io.Copy(os.Stdout, f)
+        var n int64
+        if asJSON {
+            // Only consume complete lines so records are never split
+            data, _ := io.ReadAll(f)
+            if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+                for _, ln := range strings.Split(string(data[:i]), "\n") { printEventJSON(ln) }
+                n = int64(i + 1)
+            }
+        } else {
+            n, _ = io.Copy(os.Stdout, f)
+        }
         _ = f.Close()
         if n > 0 { pos += n; _ = os.WriteFile(spos, []byte(fmt.Sprint(pos)), 0o644) }
         time.Sleep(500 * time.Millisecond)
@@ -887,7 +1552,7 @@ func suggestSummary(summaryMode, aiModel string) (summary string, used string) {
 }
 
 func doID() error {
-    uid := getUserID()
+    uid := remoteUserID()
     br, _ := currentBranch()
     local, _ := ckRef()
     pushRemote := strings.TrimSpace(getGitConfig("aigit.pushRemote"))
@@ -944,13 +1609,8 @@ func doRemoteList(remote, user string, limit int, showMeta bool) error {
         rel := relTime(time.Since(time.Unix(ct, 0)))
         fmt.Printf("%s  %6s  %s\n", sha, rel, subj)
         if showMeta {
-            body, _ := git("show", "-s", "--format=%B", sha)
-            m := parseMeta(body)
-            line := ""
-            if m.Base != "" { line += fmt.Sprintf("base=%s ", short(m.Base)) }
-            if m.Merge != "" { line += fmt.Sprintf("merge=%s ", m.Merge) }
-            if m.When != "" { line += fmt.Sprintf("when=%s", m.When) }
-            if strings.TrimSpace(line) != "" { fmt.Printf("    %s\n", strings.TrimSpace(line)) }
+            body, _ := commitBody(sha)
+            if line := metaLine(parseMeta(body)); line != "" { fmt.Printf("    %s\n", line) }
         }
     }
     return nil
@@ -965,7 +1625,13 @@ func doList(limit int, showMeta bool) error {
         fmt.Println("No checkpoints yet.")
         return nil
     }
-    format := "%h%x09%ct%x09%s"
+    br, _ := currentBranch()
+    return printSnapshots(ref, limit, showMeta, branchTags(br), "")
+}
+
+// printSnapshots prints the newest limit snapshots on ref, one per line.
+func printSnapshots(ref string, limit int, showMeta bool, tags map[string][]string, indent string) error {
+    format := "%H%x09%ct%x09%(trailers:key=Aigit-Scope,valueonly,separator=%x2C%x20)%x09%s"
     out, err := git("--no-pager", "log", "-n", strconv.Itoa(limit), "--format="+format, ref)
     if err != nil {
         return err
@@ -975,40 +1641,51 @@ func doList(limit int, showMeta bool) error {
         if strings.TrimSpace(line) == "" {
             continue
         }
-        parts := strings.SplitN(line, "\t", 3)
-        if len(parts) < 3 {
+        parts := strings.SplitN(line, "\t", 4)
+        if len(parts) < 4 {
             continue
         }
-        sha, ctStr, subj := parts[0], parts[1], parts[2]
+        sha, ctStr, scope, subj := parts[0], parts[1], parts[2], parts[3]
         ct, _ := strconv.ParseInt(ctStr, 10, 64)
         rel := relTime(time.Since(time.Unix(ct, 0)))
-        fmt.Printf("%s  %6s  %s\n", sha, rel, subj)
+        if scope != "" {
+            subj += "  (scope: " + scope + ")"
+        }
+        if names := tags[sha]; len(names) > 0 {
+            subj += "  [" + strings.Join(names, ", ") + "]"
+        }
+        sha = short(sha)
+        fmt.Printf("%s%s  %6s  %s\n", indent, sha, rel, subj)
         if showMeta {
-            body, _ := git("show", "-s", "--format=%B", sha)
-            m := parseMeta(body)
-            line := ""
-            if m.Base != "" {
-                line += fmt.Sprintf("base=%s ", short(m.Base))
-            }
-            if m.Merge != "" {
-                line += fmt.Sprintf("merge=%s ", m.Merge)
-            }
-            if m.When != "" {
-                line += fmt.Sprintf("when=%s", m.When)
-            }
-            if strings.TrimSpace(line) != "" {
-                fmt.Printf("    %s\n", strings.TrimSpace(line))
+            body, _ := commitBody(sha)
+            if line := metaLine(parseMeta(body)); line != "" {
+                fmt.Printf("%s    %s\n", indent, line)
             }
         }
     }
     return nil
 }
 
-type metaInfo struct{ Base, When, Merge string }
+type metaInfo struct {
+    Base, When, Merge string
+    User, Host, Kind  string
+    SummarySource     string
+    Model             string
+    Files             string
+    Insertions        string
+    Deletions         string
+    Index             string // tree of the user's staging area
+    Scope             []string // pathspecs of a scoped checkpoint, one Aigit-Scope trailer each
+    Submodules        []string // "<sha> <path>" of each Aigit-Submodule trailer
+    Conflicts         []string // conflicted paths, one Aigit-Conflicts trailer each
+    // Trailers holds every "Key: value" trailer of the message, Aigit-* or not.
+    Trailers map[string]string
+}
 
 func parseMeta(body string) metaInfo {
-    var m metaInfo
+    m := metaInfo{Trailers: map[string]string{}}
     scanner := bufio.NewScanner(strings.NewReader(body))
+    first := true
     for scanner.Scan() {
         s := scanner.Text()
         if strings.HasPrefix(s, "Aigit-Base:") {
@@ -1018,10 +1695,80 @@ func parseMeta(body string) metaInfo {
         } else if strings.HasPrefix(s, "Aigit-Merge:") {
             m.Merge = strings.TrimSpace(strings.TrimPrefix(s, "Aigit-Merge:"))
         }
+        // The subject line is never a trailer
+        if first {
+            first = false
+            continue
+        }
+        if k, v, ok := strings.Cut(s, ": "); ok && isTrailerKey(k) {
+            m.Trailers[k] = strings.TrimSpace(v)
+            // Trailers that repeat are also collected in order
+            switch k {
+            case "Aigit-Scope":
+                m.Scope = append(m.Scope, unquoteTrailer(v))
+            case "Aigit-Conflicts":
+                m.Conflicts = append(m.Conflicts, unquoteTrailer(v))
+            case "Aigit-Submodule":
+                m.Submodules = append(m.Submodules, strings.TrimSpace(v))
+            }
+        }
     }
+    m.User = m.Trailers["Aigit-User"]
+    m.Host = m.Trailers["Aigit-Host"]
+    m.Kind = m.Trailers["Aigit-Kind"]
+    m.SummarySource = m.Trailers["Aigit-Summary-Source"]
+    m.Model = m.Trailers["Aigit-Model"]
+    m.Files = m.Trailers["Aigit-Files"]
+    m.Insertions = m.Trailers["Aigit-Insertions"]
+    m.Deletions = m.Trailers["Aigit-Deletions"]
+    m.Index = m.Trailers["Aigit-Index"]
     return m
 }
 
+// metaLine renders trailers for `list --meta` / `remote-list --meta`.
+func metaLine(m metaInfo) string {
+    var parts []string
+    add := func(k, v string) {
+        if v != "" { parts = append(parts, k+"="+v) }
+    }
+    if m.Base != "" { add("base", short(m.Base)) }
+    add("merge", m.Merge)
+    add("when", m.When)
+    add("kind", m.Kind)
+    add("user", m.User)
+    add("host", m.Host)
+    add("summary", m.SummarySource)
+    add("model", m.Model)
+    add("scope", strings.Join(m.Scope, ", "))
+    if m.Files != "" {
+        parts = append(parts, fmt.Sprintf("files=%s +%s -%s", m.Files, defaultStr(m.Insertions, "0"), defaultStr(m.Deletions, "0")))
+    }
+    return strings.Join(parts, " ")
+}
+
+// quoteTrailer Go-quotes a trailer value that would not survive a round trip
+// as is: one with a newline, surrounding space or a leading quote.
+func quoteTrailer(v string) string {
+    if strings.ContainsAny(v, "\r\n") || strings.TrimSpace(v) != v || strings.HasPrefix(v, "\"") {
+        return strconv.Quote(v)
+    }
+    return v
+}
+
+// unquoteTrailer undoes quoteTrailer.
+func unquoteTrailer(v string) string {
+    if s, err := strconv.Unquote(v); err == nil && strings.HasPrefix(v, "\"") { return s }
+    return strings.TrimSpace(v)
+}
+
+func isTrailerKey(k string) bool {
+    if k == "" { return false }
+    for _, r := range k {
+        if !(r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') { return false }
+    }
+    return true
+}
+
 func short(sha string) string {
     if len(sha) > 7 {
         return sha[:7]
@@ -1043,21 +1790,15 @@ func relTime(d time.Duration) string {
 }
 
 func listConflicts() ([]string, error) {
-    out, err := git("diff", "--name-only", "--diff-filter=U")
+    out, err := git("diff", "--name-only", "-z", "--diff-filter=U")
     if err != nil {
         return nil, err
     }
-    var files []string
-    for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
-        line = strings.TrimSpace(line)
-        if line != "" {
-            files = append(files, line)
-        }
-    }
-    return files, nil
+    return splitNul(out), nil
 }
 
 func getGitConfig(key string) string {
+    if values, err := configValues(); err == nil { return strings.TrimSpace(values[configKey(key)]) }
     out, err := git("config", "--get", key)
     if err != nil {
         return ""
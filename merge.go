@@ -0,0 +1,196 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// ---- Three-way apply of live updates ----
+//
+// A teammate's live snapshot is not copied over the worktree. Their changes
+// since the snapshot applied last time (or, the first time, since the commit
+// they were working on) are merged into the worktree the way git merges a
+// branch: files only they changed are taken, files both sides changed are
+// merged line by line, and files only changed here are left alone. Hunks
+// that overlap with local edits follow aigit.applyConflict:
+//
+//   skip     keep your side of the conflicting hunks and report them (default)
+//   markers  write conflict markers into the file
+//   theirs   take the teammate's side of the conflicting hunks
+
+const (
+    gitlinkMode = "160000"
+    symlinkMode = "120000"
+    noMode      = "000000"
+)
+
+// applyConflictMode reads aigit.applyConflict.
+func applyConflictMode() string {
+    switch v := strings.ToLower(strings.TrimSpace(getGitConfig("aigit.applyConflict"))); v {
+    case "skip", "markers", "theirs":
+        return v
+    case "":
+    default:
+        fmt.Fprintf(os.Stderr, "unknown aigit.applyConflict %q; using skip\n", v)
+    }
+    return "skip"
+}
+
+// rawChange is one `git diff --raw` entry.
+type rawChange struct {
+    OldMode, NewMode string
+    OldSha, NewSha   string
+    Status, Path     string
+}
+
+func diffRaw(from, to string, pathspec []string) ([]rawChange, error) {
+    out, err := git(append([]string{"diff", "--raw", "-z", "--no-renames", "--no-abbrev", from, to, "--"}, pathspec...)...)
+    if err != nil { return nil, err }
+    var changes []rawChange
+    fields := splitNul(out)
+    for i := 0; i+1 < len(fields); i += 2 {
+        f := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+        if len(f) != 5 { return nil, fmt.Errorf("unexpected diff entry %q", fields[i]) }
+        changes = append(changes, rawChange{OldMode: f[0], NewMode: f[1], OldSha: f[2], NewSha: f[3], Status: f[4], Path: fields[i+1]})
+    }
+    return changes, nil
+}
+
+// mergeWorktree applies the changes between the snapshots base and sha to
+// the worktree, whose state is in opts.Before. It returns the files it
+// wrote or removed and the files with conflicting changes; label names the
+// teammate in conflict markers.
+func mergeWorktree(base, sha, label string, opts restoreOptions) ([]fileChange, []string, error) {
+    mode := applyConflictMode()
+    pathspec := opts.pathspec()
+    theirs, err := diffRaw(base, sha, pathspec)
+    if err != nil || len(theirs) == 0 { return nil, nil, err }
+    mine := opts.Before
+    if mine == "" {
+        if mine, err = snapshotTree(); err != nil { return nil, nil, err }
+    }
+    // What changed here since base, and where the worktree differs from them
+    local, err := diffRaw(base, mine, pathspec)
+    if err != nil { return nil, nil, err }
+    differ, err := diffRaw(mine, sha, pathspec)
+    if err != nil { return nil, nil, err }
+    localBy := map[string]rawChange{}
+    for _, c := range local {
+        localBy[c.Path] = c
+    }
+    differs := map[string]bool{}
+    for _, c := range differ {
+        differs[c.Path] = true
+    }
+    top, err := gitTopLevel()
+    if err != nil { return nil, nil, err }
+
+    var touched []fileChange
+    var conflicts []string
+    // Files to write go through a throwaway index and checkout-index, so
+    // modes, symlinks and checkout filters are handled the way git does
+    var info strings.Builder
+    take := func(c rawChange) error {
+        if c.NewMode == noMode {
+            abs := filepath.Join(top, filepath.FromSlash(c.Path))
+            if err := os.Remove(abs); err != nil && !os.IsNotExist(err) { return err }
+            pruneEmptyDirs(filepath.Dir(abs), top)
+        } else {
+            fmt.Fprintf(&info, "%s %s\t%s\x00", c.NewMode, c.NewSha, c.Path)
+        }
+        touched = append(touched, fileChange{Status: c.Status, Path: c.Path})
+        return nil
+    }
+    for _, c := range theirs {
+        // Submodules follow their own snapshots (see submodule.go)
+        if c.OldMode == gitlinkMode || c.NewMode == gitlinkMode { continue }
+        // Already as they have it
+        if !differs[c.Path] { continue }
+        l, changed := localBy[c.Path]
+        if !changed {
+            if err := take(c); err != nil { return touched, conflicts, err }
+            continue
+        }
+        // Both sides changed the file: merge the lines if both still have it
+        if l.NewMode != noMode && c.NewMode != noMode && l.NewMode != symlinkMode && c.NewMode != symlinkMode && c.OldMode != symlinkMode {
+            merged, n, err := mergeFile(l.NewSha, c.OldSha, c.NewSha, label, "")
+            if err == nil {
+                if n > 0 {
+                    conflicts = append(conflicts, c.Path)
+                    side := "--ours"
+                    if mode == "theirs" { side = "--theirs" }
+                    if mode != "markers" {
+                        if merged, _, err = mergeFile(l.NewSha, c.OldSha, c.NewSha, label, side); err != nil { return touched, conflicts, err }
+                    }
+                }
+                blob, err := gitInput(string(merged), "hash-object", "-w", "--stdin")
+                if err != nil { return touched, conflicts, err }
+                if blob == l.NewSha { continue }
+                fileMode := l.NewMode
+                if l.NewMode == c.OldMode { fileMode = c.NewMode }
+                if err := take(rawChange{NewMode: fileMode, NewSha: blob, Status: "M", Path: c.Path}); err != nil { return touched, conflicts, err }
+                continue
+            }
+            // Binary files cannot be merged line by line
+        }
+        conflicts = append(conflicts, c.Path)
+        if mode == "theirs" {
+            if err := take(c); err != nil { return touched, conflicts, err }
+        }
+    }
+    if info.Len() == 0 { return touched, conflicts, nil }
+    tmpdir, err := os.MkdirTemp("", "aigit-index-*")
+    if err != nil { return touched, conflicts, err }
+    defer os.RemoveAll(tmpdir)
+    env := map[string]string{"GIT_INDEX_FILE": filepath.Join(tmpdir, "index")}
+    if _, err := gitEnvInput(env, info.String(), "update-index", "-z", "--index-info"); err != nil { return touched, conflicts, err }
+    if _, err := gitEnv(env, "-C", top, "checkout-index", "-a", "-f"); err != nil { return touched, conflicts, err }
+    return touched, conflicts, nil
+}
+
+// mergeFile runs git merge-file on three blobs (a zero sha is an empty file)
+// and returns the result and the number of conflicting hunks. flag is ""
+// (conflict markers), "--ours" or "--theirs".
+func mergeFile(ours, base, theirs, label, flag string) ([]byte, int, error) {
+    tmpdir, err := os.MkdirTemp("", "aigit-merge-*")
+    if err != nil { return nil, 0, err }
+    defer os.RemoveAll(tmpdir)
+    var files []string
+    for i, sha := range []string{ours, base, theirs} {
+        var b []byte
+        if strings.Trim(sha, "0") != "" {
+            if b, err = catBlob(sha); err != nil { return nil, 0, err }
+        }
+        f := filepath.Join(tmpdir, fmt.Sprint(i))
+        if err := os.WriteFile(f, b, 0o644); err != nil { return nil, 0, err }
+        files = append(files, f)
+    }
+    args := []string{"merge-file", "-p"}
+    if flag != "" { args = append(args, flag) }
+    args = append(args, "-L", "yours", "-L", "base", "-L", label)
+    cmd := gitCommand(append(args, files...)...)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    var exit *exec.ExitError
+    // The exit status is the number of conflicts; errors are negative
+    if errors.As(err, &exit) && exit.ExitCode() > 0 && exit.ExitCode() < 128 { return out, exit.ExitCode(), nil }
+    if err != nil { return nil, 0, fmt.Errorf("git merge-file: %v: %s", err, strings.TrimSpace(stderr.String())) }
+    return out, 0, nil
+}
+
+// conflictReport describes what happened to the conflicting files.
+func conflictReport(mode, label string, conflicts []string) string {
+    files := fmt.Sprintf("%d file(s) (%s)", len(conflicts), joinPreview(conflicts))
+    switch mode {
+    case "markers":
+        return "Conflict markers written in " + files + "; resolve them before your next save"
+    case "theirs":
+        return "Took " + label + "'s side of conflicting changes in " + files
+    }
+    return "Kept your side of changes that conflict with " + label + " in " + files + " (aigit.applyConflict=markers writes them as conflicts)"
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// ---- Merge / rebase state in snapshots ----
+//
+// While a merge, rebase, cherry-pick or revert is in progress, each snapshot
+// records a state commit in its Aigit-State trailer. The state tree holds the
+// operation files from the git dir (MERGE_HEAD, MERGE_MSG, rebase-merge/,
+// ...), the full index including conflict stages (index-info), the HEAD it
+// was taken on, and every index blob under blobs/. State commits form their
+// own chain at refs/aigit/state/<branch>, which is pushed next to the
+// snapshots, and are also parented on the commits the operation refers to so
+// everything needed to resume travels with them.
+
+func stateRef(branch string) string {
+    return refRoot() + "state/" + refBranch(branch)
+}
+
+func userStateRemoteRef(user, branch string) string {
+    return "refs/aigit/users/" + user + "/state/" + refBranch(branch)
+}
+
+// opStateFiles are the single files copied from the git dir.
+var opStateFiles = []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE", "CHERRY_PICK_HEAD", "REVERT_HEAD", "REBASE_HEAD", "ORIG_HEAD"}
+
+// opStateDirs are copied recursively.
+var opStateDirs = []string{"rebase-merge", "rebase-apply"}
+
+// currentOp names the operation in progress, or "" when there is none.
+func currentOp() string {
+    dir, err := gitDir()
+    if err != nil { return "" }
+    exists := func(name string) bool {
+        _, err := os.Stat(filepath.Join(dir, name))
+        return err == nil
+    }
+    switch {
+    case exists("rebase-merge"):
+        return "rebase"
+    case exists("rebase-apply/applying"):
+        return "am"
+    case exists("rebase-apply"):
+        return "rebase"
+    case exists("MERGE_HEAD"):
+        return "merge"
+    case exists("CHERRY_PICK_HEAD"):
+        return "cherry-pick"
+    case exists("REVERT_HEAD"):
+        return "revert"
+    }
+    return ""
+}
+
+// rebasingBranch returns the branch a rebase in progress will update, so
+// snapshots taken on its detached HEAD stay on that branch's chains.
+func rebasingBranch() string {
+    dir, err := gitDir()
+    if err != nil { return "" }
+    for _, d := range opStateDirs {
+        if b, err := os.ReadFile(filepath.Join(dir, d, "head-name")); err == nil {
+            if name := strings.TrimSpace(string(b)); strings.HasPrefix(name, "refs/heads/") {
+                return strings.TrimPrefix(name, "refs/heads/")
+            }
+        }
+    }
+    return ""
+}
+
+// writeOpState records the in-progress operation as a state commit on the
+// branch's state chain.
+func writeOpState(op string) (string, error) {
+    dir, err := gitDir()
+    if err != nil { return "", err }
+    br, err := currentBranch()
+    if err != nil { return "", err }
+    ref := stateRef(br)
+    var info strings.Builder
+    var parents []string
+    prev, _ := git("rev-parse", "-q", "--verify", ref+"^{commit}")
+    if prev != "" { parents = append(parents, prev) }
+    addParent := func(s string) {
+        for _, line := range strings.Fields(s) {
+            sha, err := git("rev-parse", "-q", "--verify", line+"^{commit}")
+            if err != nil { continue }
+            for _, p := range parents {
+                if p == sha { return }
+            }
+            parents = append(parents, sha)
+        }
+    }
+    addFile := func(abs, name string) error {
+        sha, err := git("hash-object", "-w", "--", abs)
+        if err != nil { return err }
+        fmt.Fprintf(&info, "100644 %s\t%s\x00", sha, name)
+        return nil
+    }
+    for _, name := range opStateFiles {
+        abs := filepath.Join(dir, name)
+        b, err := os.ReadFile(abs)
+        if err != nil { continue }
+        if err := addFile(abs, name); err != nil { return "", err }
+        if strings.HasSuffix(name, "_HEAD") { addParent(string(b)) }
+    }
+    for _, d := range opStateDirs {
+        root := filepath.Join(dir, d)
+        err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+            if err != nil || fi.IsDir() { return nil }
+            rel, err := filepath.Rel(dir, p)
+            if err != nil { return err }
+            rel = filepath.ToSlash(rel)
+            if strings.HasSuffix(rel, "/onto") || strings.HasSuffix(rel, "/orig-head") {
+                if b, err := os.ReadFile(p); err == nil { addParent(string(b)) }
+            }
+            return addFile(p, rel)
+        })
+        if err != nil { return "", err }
+    }
+    head, err := git("rev-parse", "HEAD")
+    if err != nil { return "", err }
+    addParent(head)
+    headBlob, err := gitInput(head+"\n", "hash-object", "-w", "--stdin")
+    if err != nil { return "", err }
+    fmt.Fprintf(&info, "100644 %s\tHEAD\x00", headBlob)
+
+    // The whole index with its conflict stages, plus the blobs it names
+    entries, err := git("ls-files", "-s", "-z")
+    if err != nil { return "", err }
+    idxBlob, err := gitInput(entries, "hash-object", "-w", "--stdin")
+    if err != nil { return "", err }
+    fmt.Fprintf(&info, "100644 %s\tindex-info\x00", idxBlob)
+    seen := map[string]bool{}
+    for _, e := range splitNul(entries) {
+        f := strings.Fields(e)
+        if len(f) < 2 || f[0] == "160000" || seen[f[1]] { continue }
+        seen[f[1]] = true
+        fmt.Fprintf(&info, "100644 %s\tblobs/%s\x00", f[1], f[1])
+    }
+
+    tmpdir, err := os.MkdirTemp("", "aigit-state-*")
+    if err != nil { return "", err }
+    defer os.RemoveAll(tmpdir)
+    env := map[string]string{"GIT_INDEX_FILE": filepath.Join(tmpdir, "index")}
+    if _, err := gitEnvInput(env, info.String(), "update-index", "-z", "--index-info"); err != nil { return "", err }
+    tree, err := gitEnv(env, "write-tree")
+    if err != nil { return "", err }
+    args := []string{"commit-tree", tree}
+    for _, p := range parents {
+        args = append(args, "-p", p)
+    }
+    sha, err := gitInput("aigit state: "+op+"\n", args...)
+    if err != nil { return "", err }
+    if _, err := git("update-ref", "-m", "aigit: "+op+" state", ref, sha, prev); err != nil { return "", err }
+    return sha, nil
+}
+
+// opState is a recorded operation ready to be recreated.
+type opState struct {
+    Op, State, Head string
+}
+
+// loadOpState reads and validates the state recorded in snapshot sha, before
+// anything is touched.
+func loadOpState(sha string) (opState, error) {
+    if op := currentOp(); op != "" {
+        return opState{}, fmt.Errorf("a %s is already in progress; finish or abort it first", op)
+    }
+    body, err := commitBody(sha)
+    if err != nil { return opState{}, err }
+    m := parseMeta(body)
+    st := opState{Op: m.Trailers["Aigit-Op"], State: m.Trailers["Aigit-State"]}
+    if st.State == "" { return st, fmt.Errorf("%s has no merge/rebase state recorded", short(sha)) }
+    head, err := gitBytes("cat-file", "blob", st.State+":HEAD")
+    if err != nil {
+        return st, fmt.Errorf("state %s of %s is not in the object store (fetch it with the snapshot)", short(st.State), short(sha))
+    }
+    st.Head = strings.TrimSpace(string(head))
+    if cur, _ := git("rev-parse", "HEAD"); cur != st.Head && st.Op != "rebase" && st.Op != "am" {
+        return st, fmt.Errorf("the %s was started on %s but HEAD is %s; check out %s first", st.Op, short(st.Head), short(cur), short(st.Head))
+    }
+    return st, nil
+}
+
+// restore recreates the operation files, HEAD (detached for rebases) and the
+// conflicted index. The worktree must already match the snapshot.
+func (st opState) restore() error {
+    if cur, _ := git("rev-parse", "HEAD"); cur != st.Head {
+        // Rebases run on a detached HEAD; move there without touching files
+        if _, err := git("update-ref", "--no-deref", "-m", "aigit: restore "+st.Op+" state", "HEAD", st.Head); err != nil { return err }
+    }
+    dir, err := gitDir()
+    if err != nil { return err }
+    out, err := git("ls-tree", "-r", "-z", "--name-only", st.State)
+    if err != nil { return err }
+    for _, name := range splitNul(out) {
+        if name == "HEAD" || name == "index-info" || strings.HasPrefix(name, "blobs/") { continue }
+        b, err := gitBytes("cat-file", "blob", st.State+":"+name)
+        if err != nil { return err }
+        p := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { return err }
+        if err := os.WriteFile(p, b, 0o644); err != nil { return err }
+    }
+    entries, err := gitBytes("cat-file", "blob", st.State+":index-info")
+    if err != nil { return err }
+    if _, err := git("read-tree", "--empty"); err != nil { return err }
+    if _, err := gitInput(string(entries), "update-index", "-z", "--index-info"); err != nil { return err }
+    _, _ = git("update-index", "-q", "--refresh")
+    return nil
+}
+
+// prepareWithState validates restore/apply --with-state up front. It returns
+// nil when the option is off; otherwise the restore becomes exact.
+func prepareWithState(sha string, opts *restoreOptions) (*opState, error) {
+    if !opts.WithState { return nil, nil }
+    if len(opts.Paths) > 0 { return nil, fmt.Errorf("--with-state restores the whole snapshot; drop the pathspec") }
+    st, err := loadOpState(sha)
+    if err != nil { return nil, err }
+    opts.Exact = true
+    return &st, nil
+}
+
+// finishWithState recreates the operation after the worktree was restored.
+func finishWithState(st *opState) error {
+    if st == nil { return nil }
+    if err := st.restore(); err != nil { return fmt.Errorf("restoring %s state: %w", st.Op, err) }
+    msg := fmt.Sprintf("Restored %s in progress", st.Op)
+    if conflicts, _ := listConflicts(); len(conflicts) > 0 {
+        msg += fmt.Sprintf(" with %d conflicted files (%s)", len(conflicts), joinPreview(conflicts))
+    }
+    fmt.Printf("%s; %s.\n", msg, opResumeHint(st.Op))
+    logLine("%s", msg)
+    return nil
+}
+
+// opResumeHint tells the user how to carry on after restore --with-state.
+func opResumeHint(op string) string {
+    switch op {
+    case "rebase":
+        return "resolve, then git rebase --continue"
+    case "am":
+        return "resolve, then git am --continue"
+    case "cherry-pick", "revert":
+        return "resolve, then git " + op + " --continue"
+    }
+    return "resolve, then git commit"
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// ---- git plumbing session ----
+//
+// The watcher asks git the same questions every tick: where the repo is,
+// which branch is checked out, a handful of config values, and what a few
+// refs point at. Instead of a process per question, repo paths are cached
+// per working directory, config is loaded with one `git config --list` and
+// kept until one of the files it came from changes, the branch is read from
+// the HEAD file, and objects and revisions are looked up through long-lived
+// `git cat-file --batch` processes, one pair per repository.
+
+// gitSpawns counts git processes started, for tests and benchmarks.
+var gitSpawns atomic.Int64
+
+// plumbingOff makes every helper start its own git process, as before the
+// session existed; tests use it to measure what the session saves.
+var plumbingOff bool
+
+// gitWorkDir is where git runs instead of the working directory, as with
+// `git -C`; eachSubmodule points it at each submodule in turn.
+var gitWorkDir string
+
+func gitCommand(args ...string) *exec.Cmd {
+    gitSpawns.Add(1)
+    cmd := exec.Command("git", args...)
+    cmd.Dir = gitWorkDir
+    return cmd
+}
+
+// workDir is the directory git commands run in.
+func workDir() (string, error) {
+    if gitWorkDir != "" { return gitWorkDir, nil }
+    return os.Getwd()
+}
+
+// repoPaths are the absolute git dir, common dir and top level of a repo.
+type repoPaths struct {
+    GitDir, CommonDir, Top string
+}
+
+var repoCache = struct {
+    sync.Mutex
+    m map[string]repoPaths
+}{m: map[string]repoPaths{}}
+
+// repoInfo returns the paths of the repo containing workDir.
+// Results are cached per directory as long as the git dir exists; failures
+// (not a repo yet, bare repo) are not cached.
+func repoInfo() (repoPaths, error) {
+    cwd, err := workDir()
+    if err != nil { return repoPaths{}, err }
+    repoCache.Lock()
+    p, ok := repoCache.m[cwd]
+    repoCache.Unlock()
+    if ok && !plumbingOff {
+        if _, err := os.Stat(p.GitDir); err == nil { return p, nil }
+    }
+    out, err := git("rev-parse", "--path-format=absolute", "--git-dir", "--git-common-dir", "--show-toplevel")
+    if err != nil { return repoPaths{}, err }
+    f := strings.Split(out, "\n")
+    if len(f) != 3 { return repoPaths{}, fmt.Errorf("unexpected rev-parse output %q", out) }
+    p = repoPaths{GitDir: f[0], CommonDir: f[1], Top: f[2]}
+    repoCache.Lock()
+    repoCache.m[cwd] = p
+    repoCache.Unlock()
+    return p, nil
+}
+
+// ---- Config cache ----
+
+type configCache struct {
+    files  []string
+    stats  []os.FileInfo
+    env    string
+    values map[string]string
+}
+
+var configs = struct {
+    sync.Mutex
+    m map[string]*configCache
+}{m: map[string]*configCache{}}
+
+// configEnv captures the environment that decides which config files git reads.
+func configEnv() string {
+    var b strings.Builder
+    for _, kv := range os.Environ() {
+        if strings.HasPrefix(kv, "GIT_CONFIG") || strings.HasPrefix(kv, "HOME=") || strings.HasPrefix(kv, "XDG_CONFIG_HOME=") {
+            b.WriteString(kv + "\x00")
+        }
+    }
+    return b.String()
+}
+
+// configFiles lists where config may come from, including files that do not
+// exist yet so that creating them is noticed.
+func configFiles(p repoPaths) []string {
+    files := []string{filepath.Join(p.CommonDir, "config"), filepath.Join(p.GitDir, "config.worktree")}
+    if g := os.Getenv("GIT_CONFIG_GLOBAL"); g != "" {
+        files = append(files, g)
+    } else if home, err := os.UserHomeDir(); err == nil {
+        xdg := os.Getenv("XDG_CONFIG_HOME")
+        if xdg == "" { xdg = filepath.Join(home, ".config") }
+        files = append(files, filepath.Join(home, ".gitconfig"), filepath.Join(xdg, "git", "config"))
+    }
+    return files
+}
+
+func statFiles(files []string) []os.FileInfo {
+    stats := make([]os.FileInfo, len(files))
+    for i, f := range files {
+        stats[i], _ = os.Stat(f)
+    }
+    return stats
+}
+
+// fresh reports whether none of the config files changed since loading.
+// Replacing a file (git config writes through a lock file and a rename)
+// shows up as a different file even when size and mtime match.
+func (c *configCache) fresh() bool {
+    if c.env != configEnv() { return false }
+    for i, fi := range statFiles(c.files) {
+        old := c.stats[i]
+        if (fi == nil) != (old == nil) { return false }
+        if fi != nil && (!os.SameFile(fi, old) || !fi.ModTime().Equal(old.ModTime()) || fi.Size() != old.Size()) { return false }
+    }
+    return true
+}
+
+// loadConfig reads every config value with one git process. The files are
+// statted first, so a change racing with the read forces another load.
+func loadConfig(p repoPaths) (*configCache, error) {
+    c := &configCache{files: configFiles(p), env: configEnv(), values: map[string]string{}}
+    c.stats = statFiles(c.files)
+    out, err := gitBytes("config", "-z", "--list", "--show-origin")
+    if err != nil { return nil, err }
+    seen := map[string]bool{}
+    for _, f := range c.files {
+        seen[f] = true
+    }
+    fields := strings.Split(string(out), "\x00")
+    for i := 0; i+1 < len(fields); i += 2 {
+        // Included and system files are watched too
+        if file, ok := strings.CutPrefix(fields[i], "file:"); ok {
+            if abs, err := filepath.Abs(file); err == nil && !seen[abs] {
+                seen[abs] = true
+                c.files = append(c.files, abs)
+                c.stats = append(c.stats, statFiles([]string{abs})...)
+            }
+        }
+        k, v, _ := strings.Cut(fields[i+1], "\n")
+        // Later values win, as with git config --get
+        c.values[k] = v
+    }
+    return c, nil
+}
+
+// configValues returns the cached config of the current repo.
+func configValues() (map[string]string, error) {
+    p, err := repoInfo()
+    if err != nil { return nil, err }
+    configs.Lock()
+    defer configs.Unlock()
+    if c := configs.m[p.GitDir]; c != nil && c.fresh() && !plumbingOff { return c.values, nil }
+    c, err := loadConfig(p)
+    if err != nil { return nil, err }
+    configs.m[p.GitDir] = c
+    return c.values, nil
+}
+
+// configKey normalizes a key the way git config --list prints it: section
+// and variable names are case-insensitive, subsections are not.
+func configKey(key string) string {
+    i, j := strings.IndexByte(key, '.'), strings.LastIndexByte(key, '.')
+    if i < 0 { return strings.ToLower(key) }
+    return strings.ToLower(key[:i]) + key[i:j] + strings.ToLower(key[j:])
+}
+
+// ---- cat-file sessions ----
+
+// catFile is one running `git cat-file --batch` or `--batch-check`.
+type catFile struct {
+    cmd *exec.Cmd
+    in  io.WriteCloser
+    out *bufio.Reader
+}
+
+func startCatFile(gitDir, mode string) (*catFile, error) {
+    cmd := gitCommand("--git-dir="+gitDir, "cat-file", mode)
+    in, err := cmd.StdinPipe()
+    if err != nil { return nil, err }
+    out, err := cmd.StdoutPipe()
+    if err != nil { return nil, err }
+    if err := cmd.Start(); err != nil { return nil, err }
+    return &catFile{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+func (c *catFile) close() {
+    _ = c.in.Close()
+    _ = c.cmd.Wait()
+}
+
+// errNoObject is returned for names that do not resolve to an object.
+var errNoObject = errors.New("no such object")
+
+// query looks up name and returns the header fields (sha, type, size) and,
+// in --batch mode, the contents.
+func (c *catFile) query(name string, contents bool) ([]string, []byte, error) {
+    if _, err := io.WriteString(c.in, name+"\n"); err != nil { return nil, nil, err }
+    line, err := c.out.ReadString('\n')
+    if err != nil { return nil, nil, err }
+    line = strings.TrimSuffix(line, "\n")
+    if line == name+" missing" || line == name+" ambiguous" { return nil, nil, errNoObject }
+    hdr := strings.Fields(line)
+    if len(hdr) != 3 { return nil, nil, fmt.Errorf("cat-file: unexpected reply %q", line) }
+    if !contents { return hdr, nil, nil }
+    size, err := strconv.Atoi(hdr[2])
+    if err != nil { return nil, nil, fmt.Errorf("cat-file: unexpected reply %q", line) }
+    // The contents are followed by a newline
+    buf := make([]byte, size+1)
+    if _, err := io.ReadFull(c.out, buf); err != nil { return nil, nil, err }
+    return hdr, buf[:size], nil
+}
+
+// gitSession holds the cat-file processes of one repository.
+type gitSession struct {
+    mu           sync.Mutex
+    check, batch *catFile
+    used         int64
+    closed       bool
+}
+
+// maxSessions bounds the repositories (submodules, test repos) with live
+// cat-file processes; the least recently used one is closed beyond that.
+const maxSessions = 8
+
+var sessions = struct {
+    sync.Mutex
+    m     map[string]*gitSession
+    clock int64
+}{m: map[string]*gitSession{}}
+
+func (s *gitSession) close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, c := range []*catFile{s.check, s.batch} {
+        if c != nil { c.close() }
+    }
+    s.check, s.batch, s.closed = nil, nil, true
+}
+
+func sessionFor(gitDir string) *gitSession {
+    sessions.Lock()
+    defer sessions.Unlock()
+    sessions.clock++
+    s := sessions.m[gitDir]
+    if s == nil {
+        if len(sessions.m) >= maxSessions {
+            var oldest string
+            for d, o := range sessions.m {
+                if oldest == "" || o.used < sessions.m[oldest].used { oldest = d }
+            }
+            go sessions.m[oldest].close()
+            delete(sessions.m, oldest)
+        }
+        s = &gitSession{}
+        sessions.m[gitDir] = s
+    }
+    s.used = sessions.clock
+    return s
+}
+
+// closeGitSessions stops every cat-file process.
+func closeGitSessions() {
+    sessions.Lock()
+    defer sessions.Unlock()
+    for d, s := range sessions.m {
+        s.close()
+        delete(sessions.m, d)
+    }
+}
+
+// catFileQuery asks the current repo's session about name. A process that
+// fails is dropped and restarted on the next call.
+func catFileQuery(name string, contents bool) ([]string, []byte, error) {
+    if strings.ContainsAny(name, "\n") { return nil, nil, errors.New("cat-file: name contains a newline") }
+    if plumbingOff { return nil, nil, errors.New("cat-file: plumbing session off") }
+    p, err := repoInfo()
+    if err != nil { return nil, nil, err }
+    s := sessionFor(p.GitDir)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed { return nil, nil, errors.New("cat-file: session closed") }
+    c, mode := &s.check, "--batch-check"
+    if contents { c, mode = &s.batch, "--batch" }
+    if *c == nil {
+        if *c, err = startCatFile(p.GitDir, mode); err != nil { return nil, nil, err }
+    }
+    hdr, body, err := (*c).query(name, contents)
+    if err != nil && !errors.Is(err, errNoObject) {
+        (*c).close()
+        *c = nil
+    }
+    return hdr, body, err
+}
+
+// revParse resolves spec like `git rev-parse -q --verify spec`.
+func revParse(spec string) (string, error) {
+    hdr, _, err := catFileQuery(spec, false)
+    if errors.Is(err, errNoObject) { return "", fmt.Errorf("%s: %w", spec, err) }
+    if err != nil { return git("rev-parse", "-q", "--verify", spec) }
+    return hdr[0], nil
+}
+
+// readCommit returns the tree and the raw message (as %T and %B) of the
+// commit rev names.
+func readCommit(rev string) (string, string, error) {
+    _, obj, err := catFileQuery(rev+"^{commit}", true)
+    if errors.Is(err, errNoObject) { return "", "", fmt.Errorf("%s: %w", rev, err) }
+    if err != nil {
+        out, err := git("show", "-s", "--format=%T%x1f%B", rev)
+        if err != nil { return "", "", err }
+        tree, body, _ := strings.Cut(out, "\x1f")
+        return tree, body, nil
+    }
+    header, body, _ := strings.Cut(string(obj), "\n\n")
+    tree, _, _ := strings.Cut(strings.TrimPrefix(header, "tree "), "\n")
+    return tree, strings.TrimSpace(body), nil
+}
+
+// commitBody is the message of commit rev.
+func commitBody(rev string) (string, error) {
+    _, body, err := readCommit(rev)
+    return body, err
+}
+
+// catBlob returns the contents of blob sha.
+func catBlob(sha string) ([]byte, error) {
+    _, obj, err := catFileQuery(sha, true)
+    if errors.Is(err, errNoObject) { return nil, fmt.Errorf("%s: %w", sha, err) }
+    if err != nil { return gitBytes("cat-file", "blob", sha) }
+    return obj, nil
+}
+
+// headBranch reads the checked-out branch straight from the HEAD file. ok
+// is false when HEAD is not a plain branch or the file cannot be read
+// (detached, or a ref backend without a readable HEAD).
+func headBranch() (string, bool) {
+    if plumbingOff { return "", false }
+    p, err := repoInfo()
+    if err != nil { return "", false }
+    b, err := os.ReadFile(filepath.Join(p.GitDir, "HEAD"))
+    if err != nil { return "", false }
+    name, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "ref: refs/heads/")
+    if !ok || name == ".invalid" { return "", false }
+    return name, true
+}
+
+// refTips maps every ref under prefix to the object it points at. The ref
+// files are read directly where possible, otherwise with a single
+// for-each-ref.
+func refTips(prefix string) (map[string]string, error) {
+    if tips, ok := readRefFiles(prefix); ok { return tips, nil }
+    out, err := git("for-each-ref", "--format=%(objectname) %(refname)", prefix)
+    if err != nil { return nil, err }
+    tips := map[string]string{}
+    for _, line := range strings.Split(out, "\n") {
+        if sha, ref, ok := strings.Cut(line, " "); ok { tips[ref] = sha }
+    }
+    return tips, nil
+}
+
+// readRefFiles reads the refs under prefix from packed-refs and the loose
+// ref files of the common dir. ok is false when they are not stored that
+// way (reftable, per-worktree refs) or a ref is not a plain object name.
+func readRefFiles(prefix string) (map[string]string, bool) {
+    if plumbingOff || !strings.HasPrefix(prefix, "refs/") { return nil, false }
+    for _, wt := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+        if strings.HasPrefix(prefix, wt) { return nil, false }
+    }
+    p, err := repoInfo()
+    if err != nil { return nil, false }
+    if _, err := os.Stat(filepath.Join(p.CommonDir, "reftable")); err == nil { return nil, false }
+    tips := map[string]string{}
+    if b, err := os.ReadFile(filepath.Join(p.CommonDir, "packed-refs")); err == nil {
+        // "<sha> <ref>" lines; "#" headers and "^" peeled lines have no space
+        for _, line := range strings.Split(string(b), "\n") {
+            if sha, ref, ok := strings.Cut(line, " "); ok && isObjectName(sha) && strings.HasPrefix(ref, prefix) { tips[ref] = sha }
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, false
+    }
+    // Loose refs win over packed ones
+    root := filepath.Join(p.CommonDir, filepath.FromSlash(prefix))
+    err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) { return nil }
+            return err
+        }
+        if d.IsDir() || strings.HasSuffix(path, ".lock") { return nil }
+        b, err := os.ReadFile(path)
+        if err != nil { return err }
+        sha := strings.TrimSpace(string(b))
+        if !isObjectName(sha) { return fmt.Errorf("%s is not a plain ref", path) }
+        rel, err := filepath.Rel(p.CommonDir, path)
+        if err != nil { return err }
+        tips[filepath.ToSlash(rel)] = sha
+        return nil
+    })
+    if err != nil { return nil, false }
+    return tips, true
+}
+
+// isObjectName reports whether s is a full SHA-1 or SHA-256 object name.
+func isObjectName(s string) bool {
+    if len(s) != 40 && len(s) != 64 { return false }
+    for _, r := range s {
+        if !strings.ContainsRune("0123456789abcdef", r) { return false }
+    }
+    return true
+}
+
+// ---- Full-scan cache ----
+//
+// The watcher rescans the whole worktree into its private index every
+// tick. When `git add -A -v` reports nothing added or removed and neither
+// the index nor the exclude files changed behind our back, the tree of the
+// previous scan still stands, so write-tree and the ignored-entries check
+// are skipped.
+
+var lastScan = struct {
+    sync.Mutex
+    idx, stamp, tree string
+}{}
+
+// scanStamp identifies the state of the private index idx and the exclude
+// files outside the worktree (.gitignore files are in the tree itself).
+func scanStamp(idx string) string {
+    if plumbingOff { return "" }
+    files := []string{idx}
+    if p, err := repoInfo(); err == nil { files = append(files, filepath.Join(p.CommonDir, "info", "exclude")) }
+    excludes := getGitConfig("core.excludesFile")
+    if rest, ok := strings.CutPrefix(excludes, "~/"); ok {
+        if home, err := os.UserHomeDir(); err == nil { excludes = filepath.Join(home, rest) }
+    }
+    if excludes == "" {
+        if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+            excludes = filepath.Join(xdg, "git", "ignore")
+        } else if home, err := os.UserHomeDir(); err == nil {
+            excludes = filepath.Join(home, ".config", "git", "ignore")
+        }
+    }
+    files = append(files, excludes)
+    var b strings.Builder
+    for i, fi := range statFiles(files) {
+        if fi == nil { continue }
+        fmt.Fprintf(&b, "%s %d %d\x00", files[i], fi.Size(), fi.ModTime().UnixNano())
+    }
+    return b.String()
+}
+
+// lastScanTree returns the tree of the previous full scan of idx when
+// stamp, taken before `git add -A -v` printed added, shows that nothing
+// changed since.
+func lastScanTree(idx, stamp, added string) (string, bool) {
+    lastScan.Lock()
+    defer lastScan.Unlock()
+    if plumbingOff || added != "" || lastScan.tree == "" || lastScan.idx != idx || lastScan.stamp != stamp {
+        lastScan.tree = ""
+        return "", false
+    }
+    // add may have rewritten the index file
+    lastScan.stamp = scanStamp(idx)
+    return lastScan.tree, true
+}
+
+// rememberScan records tree as the result of a full scan of idx.
+func rememberScan(idx, tree string) {
+    lastScan.Lock()
+    defer lastScan.Unlock()
+    lastScan.idx, lastScan.stamp, lastScan.tree = idx, scanStamp(idx), tree
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// ---- Publish: squash checkpoints into a real branch commit ----
+
+type publishOptions struct {
+    Live    bool   // publish from refs/aigit/live/<branch> instead of checkpoints
+    Since   string // exclusive lower bound of the range
+    Last    int    // publish the newest N snapshots
+    Rebase  bool   // allow publishing when HEAD moved past Aigit-Base
+    Message string // explicit subject; skips summary generation
+    Summary string // ai|diff|off
+    Model   string
+}
+
+// ckEntry is one snapshot commit read from a checkpoint or live chain.
+type ckEntry struct {
+    Sha     string
+    Subject string
+    Meta    metaInfo
+}
+
+// publishedRef anchors the newest snapshot already published from source.
+// source is a full ref such as refs/aigit/checkpoints/<branch>.
+func publishedRef(source string) string {
+    return "refs/aigit/published/" + strings.TrimPrefix(source, "refs/aigit/")
+}
+
+// readEntries returns snapshot commits (newest first) for the given rev-list args.
+func readEntries(args ...string) ([]ckEntry, error) {
+    out, err := git(append([]string{"log", "--format=%H%x1f%s%x1f%B%x1e"}, args...)...)
+    if err != nil { return nil, err }
+    var entries []ckEntry
+    for _, rec := range strings.Split(out, "\x1e") {
+        rec = strings.TrimSpace(rec)
+        if rec == "" { continue }
+        parts := strings.SplitN(rec, "\x1f", 3)
+        if len(parts) < 3 { continue }
+        entries = append(entries, ckEntry{Sha: parts[0], Subject: parts[1], Meta: parseMeta(parts[2])})
+    }
+    return entries, nil
+}
+
+func doPublish(opts publishOptions) error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    if op := currentOp(); op != "" { return fmt.Errorf("cannot publish during a %s; finish it first", op) }
+    if isDetached(br) { return errors.New("cannot publish on a detached HEAD; check out a branch first") }
+    source, err := ckRef()
+    if err != nil { return err }
+    if opts.Live { source = liveLocalRef(br) }
+    tip, err := git("rev-parse", "-q", "--verify", source+"^{commit}")
+    if err != nil { return fmt.Errorf("no snapshots on %s", source) }
+
+    anchorRef := publishedRef(source)
+    anchor, _ := git("rev-parse", "-q", "--verify", anchorRef+"^{commit}")
+    if anchor != "" && isAncestor(tip, anchor) {
+        fmt.Printf("Nothing new to publish (%s already published).\n", short(tip))
+        return nil
+    }
+
+    // Select the range (newest first)
+    var entries []ckEntry
+    switch {
+    case strings.TrimSpace(opts.Since) != "":
+        since, rerr := resolveRev(opts.Since)
+        if rerr != nil { return rerr }
+        if since.Worktree { return errors.New("--since needs a snapshot, not the worktree") }
+        entries, err = readEntries(tip, "^"+since.Commit)
+    case opts.Last > 0:
+        entries, err = readEntries("-n", strconv.Itoa(opts.Last), tip)
+    case anchor != "" && isAncestor(anchor, tip):
+        entries, err = readEntries(tip, "^"+anchor)
+    default:
+        // No previous publish: take the run of snapshots sharing the tip's base commit
+        entries, err = readEntries(tip)
+        if err == nil && len(entries) > 0 {
+            base := entries[0].Meta.Base
+            n := 0
+            for n < len(entries) && entries[n].Meta.Base == base { n++ }
+            entries = entries[:n]
+        }
+    }
+    if err != nil { return err }
+    if len(entries) == 0 { return errors.New("no checkpoints in the selected range") }
+    newest := entries[0]
+    oldest := entries[len(entries)-1]
+
+    tree, err := git("rev-parse", newest.Sha+"^{tree}")
+    if err != nil { return err }
+    head, _ := git("rev-parse", "-q", "--verify", "HEAD^{commit}")
+    base := newest.Meta.Base
+    if strings.Trim(base, "0") == "" { base = "" }
+    if head != base {
+        if !opts.Rebase {
+            return fmt.Errorf("HEAD (%s) has moved past the checkpoints' base (%s); re-run with --rebase", short(defaultStr(head, "unborn")), short(defaultStr(base, "unborn")))
+        }
+        tree, err = rebaseTree(newest.Sha, base, head)
+        if err != nil { return err }
+    }
+    if head != "" {
+        if headTree, _ := git("rev-parse", head+"^{tree}"); headTree == tree {
+            fmt.Println("Checkpoint tree matches HEAD; nothing to publish.")
+            _, _ = git("update-ref", "-m", "aigit: publish (no-op)", anchorRef, newest.Sha)
+            return nil
+        }
+    }
+
+    msg := publishMessage(opts, entries, head, tree)
+    msg += "\n\nAigit-Published: " + oldest.Sha + ".." + newest.Sha + "\n"
+    args := []string{"commit-tree", tree}
+    if head != "" { args = append(args, "-p", head) }
+    newSha, err := gitInput(msg, args...)
+    if err != nil { return err }
+
+    // Record whether the index matched HEAD so we only resync it when safe
+    indexClean := true
+    if head != "" {
+        _, err := git("diff", "--cached", "--quiet")
+        indexClean = err == nil
+    }
+    subject := strings.SplitN(msg, "\n", 2)[0]
+    branchRef := "refs/heads/" + br
+    if head != "" {
+        _, err = git("update-ref", "-m", "aigit publish: "+subject, branchRef, newSha, head)
+    } else {
+        _, err = git("update-ref", "-m", "aigit publish: "+subject, branchRef, newSha, "")
+    }
+    if err != nil { return err }
+    if _, err := git("update-ref", "-m", "aigit: publish", anchorRef, newest.Sha); err != nil { return err }
+    if indexClean {
+        _, _ = git("reset", "-q")
+    } else {
+        fmt.Fprintln(os.Stderr, "Index had staged changes; left as-is (run 'git reset' to sync it with the new commit).")
+    }
+
+    fmt.Printf("Published %d checkpoint(s) %s..%s to %s\n", len(entries), short(oldest.Sha), short(newest.Sha), br)
+    fmt.Printf("Commit: %s  (%s)\n", newSha, subject)
+    logLine("Published %d checkpoint(s) to %s: %s  (%s)", len(entries), br, newSha, subject)
+    return nil
+}
+
+// publishMessage composes the commit message: a top line plus bullets from
+// the range's subjects (oldest first, deduplicated).
+func publishMessage(opts publishOptions, entries []ckEntry, head, tree string) string {
+    var subjects []string
+    seen := map[string]bool{}
+    for i := len(entries) - 1; i >= 0; i-- {
+        s := strings.TrimSpace(entries[i].Subject)
+        if s == "" || s == "(auto)" || seen[s] { continue }
+        seen[s] = true
+        subjects = append(subjects, s)
+    }
+    subject := strings.TrimSpace(opts.Message)
+    if subject == "" && strings.EqualFold(opts.Summary, "ai") {
+        from := head
+        if from == "" { from = emptyTree }
+        if diff, err := git("diff-tree", "--name-status", "-r", "-M", from, tree); err == nil {
+            if s, err := summarizeDiffWithAI(opts.Model, diff); err == nil && strings.TrimSpace(s) != "" {
+                subject = s
+            } else if err != nil {
+                fmt.Fprintf(os.Stderr, "AI summary failed, falling back to checkpoint subjects: %v\n", err)
+            }
+        }
+    }
+    if subject == "" && len(subjects) > 0 { subject = subjects[len(subjects)-1] }
+    if subject == "" { subject = fmt.Sprintf("Publish %d checkpoints", len(entries)) }
+    var b strings.Builder
+    b.WriteString(subject)
+    if len(subjects) > 1 || (len(subjects) == 1 && subjects[0] != subject) {
+        b.WriteString("\n")
+        for _, s := range subjects {
+            b.WriteString("\n- " + s)
+        }
+    }
+    return b.String()
+}
+
+// emptyTree is git's well-known empty tree object id.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// rebaseTree replays the change from base to snapshot onto head and returns the
+// resulting tree. A throwaway commit parented on base gives merge-tree the
+// right merge base, since snapshot chains do not descend from their base.
+func rebaseTree(snapshot, base, head string) (string, error) {
+    if head == "" { return "", errors.New("cannot rebase onto an unborn branch") }
+    tree, err := git("rev-parse", snapshot+"^{tree}")
+    if err != nil { return "", err }
+    args := []string{"commit-tree", tree}
+    if base != "" { args = append(args, "-p", base) }
+    tmp, err := gitInput("aigit rebase helper\n", args...)
+    if err != nil { return "", err }
+    out, err := git("merge-tree", "--write-tree", "--allow-unrelated-histories", head, tmp)
+    if err != nil {
+        return "", fmt.Errorf("checkpoints conflict with HEAD; resolve manually (restore, commit) instead: %v", err)
+    }
+    return strings.TrimSpace(strings.SplitN(out, "\n", 2)[0]), nil
+}
+
+func isAncestor(a, b string) bool {
+    _, err := git("merge-base", "--is-ancestor", a, b)
+    return err == nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// ---- Worktree restore plumbing (restore, apply, auto-apply) ----
+
+type restoreOptions struct {
+    // Exact makes the worktree mirror the snapshot: files that exist now but
+    // not in the snapshot (tracked or untracked) are removed. Ignored files
+    // are never touched.
+    Exact bool
+    // Paths limits the restore to these pathspecs (relative to the cwd).
+    Paths []string
+    // Before is a commit or tree holding the current worktree state (e.g. the
+    // undo snapshot). When empty it is computed on demand.
+    Before string
+    // Staged also resets the real index to the staging area recorded in the
+    // snapshot's Aigit-Index trailer (restore --staged / --index).
+    Staged bool
+    // WithState recreates a merge/rebase recorded with the snapshot (see
+    // opstate.go). Implies Exact.
+    WithState bool
+}
+
+// fileChange is one name-status entry.
+type fileChange struct {
+    Status string
+    Path   string
+}
+
+func (c fileChange) String() string { return c.Status + "\t" + c.Path }
+
+// restoreWorktree writes the snapshot's files into the worktree without moving
+// HEAD and returns the files it touched (D entries only in exact mode).
+// Submodules recorded in the snapshot follow unless a pathspec is given.
+func restoreWorktree(sha string, opts restoreOptions) ([]fileChange, error) {
+    touched, err := restoreFiles(sha, opts)
+    if err != nil || len(opts.Paths) > 0 { return touched, err }
+    subs, err := restoreSubmodules(sha, opts)
+    return append(touched, subs...), err
+}
+
+func restoreFiles(sha string, opts restoreOptions) ([]fileChange, error) {
+    pathspec := opts.pathspec()
+    before := opts.Before
+    if before == "" {
+        tree, err := snapshotTree()
+        if err != nil { return nil, err }
+        before = tree
+    }
+    out, err := git(append([]string{"diff", "-z", "--name-status", "--no-renames", before, sha, "--"}, pathspec...)...)
+    if err != nil { return nil, err }
+    var touched []fileChange
+    writes := 0
+    top, err := gitTopLevel()
+    if err != nil { return nil, err }
+    fields := splitNul(out)
+    for i := 0; i+1 < len(fields); i += 2 {
+        c := fileChange{Status: fields[i], Path: fields[i+1]}
+        if c.Status == "D" {
+            // Present in the worktree but not in the snapshot
+            if !opts.Exact { continue }
+            abs := filepath.Join(top, filepath.FromSlash(c.Path))
+            if err := os.Remove(abs); err != nil && !os.IsNotExist(err) { return touched, err }
+            pruneEmptyDirs(filepath.Dir(abs), top)
+        } else {
+            writes++
+        }
+        touched = append(touched, c)
+    }
+    if writes == 0 { return touched, nil }
+    // Prefer git restore, fallback to checkout for older Git
+    if _, err := git(append([]string{"restore", "--worktree", "--source", sha, "--"}, pathspec...)...); err != nil {
+        if _, err2 := git(append([]string{"checkout", sha, "--"}, pathspec...)...); err2 != nil {
+            return touched, fmt.Errorf("restore failed: %v; fallback checkout failed: %v", err, err2)
+        }
+    }
+    return touched, nil
+}
+
+// applyScope limits a restore of a scoped checkpoint to the paths it was
+// taken from, since everything else was carried over from an older snapshot.
+// An explicit pathspec (e.g. "-- .") overrides it.
+func applyScope(sha string, opts *restoreOptions) error {
+    if len(opts.Paths) > 0 || opts.WithState { return nil }
+    body, err := commitBody(sha)
+    if err != nil { return err }
+    scope := parseMeta(body).Scope
+    if len(scope) == 0 { return nil }
+    for _, p := range scope {
+        if !strings.HasPrefix(p, ":") { p = ":(top)" + p }
+        opts.Paths = append(opts.Paths, p)
+    }
+    fmt.Printf("%s is scoped to %s; restoring only those paths (pass -- . for everything).\n", short(sha), strings.Join(scope, ", "))
+    return nil
+}
+
+// pathspec is the part of the repository a restore covers.
+func (o restoreOptions) pathspec() []string {
+    if len(o.Paths) > 0 { return o.Paths }
+    // Exact mode covers the whole repository, not just the cwd
+    if o.Exact { return []string{":/"} }
+    return []string{"."}
+}
+
+// restoreIndex resets the real index to the staging area recorded with sha,
+// leaving the worktree alone.
+func restoreIndex(sha string, opts restoreOptions) error {
+    body, err := commitBody(sha)
+    if err != nil { return err }
+    idx := parseMeta(body).Index
+    if idx == "" { return fmt.Errorf("%s has no recorded staging area (Aigit-Index); worktree restored, index left as-is", short(sha)) }
+    if _, err := git("cat-file", "-e", idx+"^{tree}"); err != nil {
+        return fmt.Errorf("staging area %s of %s is no longer in the object store; worktree restored, index left as-is", short(idx), short(sha))
+    }
+    pathspec := opts.pathspec()
+    if _, err := git(append([]string{"restore", "--staged", "--source", idx, "--"}, pathspec...)...); err != nil {
+        if _, err2 := git(append([]string{"reset", "-q", idx, "--"}, pathspec...)...); err2 != nil {
+            return fmt.Errorf("index restore failed: %v; fallback reset failed: %v", err, err2)
+        }
+    }
+    return nil
+}
+
+// echoFiles prints changes in the same "Files:" block format used for
+// checkpoints, truncated to 20 entries. The block is also written to the
+// event log when log is set.
+func echoFiles(changes []fileChange, echo, log bool) {
+    if len(changes) == 0 { return }
+    if echo { fmt.Println("Files:") }
+    if log { logLine("Files:") }
+    for i, c := range changes {
+        if i >= 20 {
+            if echo { fmt.Println("  ...") }
+            if log { logLine("  ...") }
+            break
+        }
+        if echo { fmt.Printf("  %s\n", c) }
+        if log { logLine("  %s", c) }
+    }
+}
+
+// parseNameStatus parses `git diff --name-status` / `diff-tree` text output.
+func parseNameStatus(out string) []fileChange {
+    var changes []fileChange
+    for _, line := range strings.Split(out, "\n") {
+        parts := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+        if len(parts) < 2 { continue }
+        changes = append(changes, fileChange{Status: parts[0], Path: parts[1]})
+    }
+    return changes
+}
+
+// pruneEmptyDirs removes dir and its empty parents, stopping at top.
+func pruneEmptyDirs(dir, top string) {
+    for dir != top && strings.HasPrefix(dir, top) {
+        if err := os.Remove(dir); err != nil { return }
+        dir = filepath.Dir(dir)
+    }
+}
+
+// splitNul splits -z output into its non-empty entries.
+func splitNul(out string) []string {
+    var items []string
+    for _, s := range strings.Split(out, "\x00") {
+        if s != "" { items = append(items, s) }
+    }
+    return items
+}
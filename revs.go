@@ -0,0 +1,205 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Snapshot addressing ----
+//
+// Aigit commands accept the usual git revisions plus a few shorthands:
+//
+//   ck, checkpoints     refs/aigit/checkpoints/<branch>
+//   live                refs/aigit/live/<branch>
+//   user:<id>           a teammate's fetched live ref (remoteTrackingLiveRef)
+//   worktree            the current working tree (diff only)
+//   <name>              a named checkpoint (refs/aigit/tags/<branch>/<name>)
+//
+// followed by optional git suffixes (live~3, ck^) and a time selector:
+// ck@{10m} picks the newest snapshot at least 10 minutes old, and
+// live@{yesterday} or user:alice@{2026-10-17 14:00} the newest one taken by
+// then (see parseWhen). A bare @{20m} searches checkpoints and live
+// snapshots together. git's own selectors (HEAD@{1}, @{-1}, main@{upstream},
+// @{push}) are not times and go to git unchanged.
+
+// rev is a resolved snapshot spec.
+type rev struct {
+    Spec     string
+    Commit   string // full sha; empty for the worktree
+    Worktree bool
+}
+
+// resolveRev turns a spec into a commit (or the worktree marker).
+func resolveRev(spec string) (rev, error) {
+    spec = strings.TrimSpace(spec)
+    if spec == "worktree" {
+        return rev{Spec: spec, Worktree: true}, nil
+    }
+    name, when, suffix, err := splitRevSpec(spec)
+    if err != nil { return rev{}, err }
+    refs := []string{name}
+    if name == "" && !gitSelector(when) {
+        refs = []string{"ck"}
+        if when != "" { refs = append(refs, "live") }
+    }
+    for i, n := range refs {
+        if refs[i], err = expandRevName(n); err != nil { return rev{}, err }
+    }
+    ref := refs[0]
+    if gitSelector(when) {
+        ref, when = ref+"@{"+when+"}", ""
+    }
+    if when != "" {
+        t, err := parseWhen(when)
+        if err != nil { return rev{}, fmt.Errorf("%s: %w", spec, err) }
+        if ref, err = snapshotAt(refs, t); err != nil { return rev{}, fmt.Errorf("%s: %w", spec, err) }
+    }
+    sha, err := git("rev-parse", "-q", "--verify", ref+suffix+"^{commit}")
+    if err != nil { return rev{}, fmt.Errorf("unknown revision %q", spec) }
+    return rev{Spec: spec, Commit: sha}, nil
+}
+
+// splitRevSpec splits "name@{when}~N" into its parts.
+func splitRevSpec(spec string) (name, when, suffix string, err error) {
+    rest := spec
+    if i := strings.Index(rest, "@{"); i >= 0 {
+        j := strings.Index(rest[i:], "}")
+        if j < 0 { return "", "", "", fmt.Errorf("unterminated @{ in %q", spec) }
+        name, when, suffix = rest[:i], rest[i+2:i+j], rest[i+j+1:]
+    } else if i := strings.IndexAny(rest, "~^"); i >= 0 {
+        name, suffix = rest[:i], rest[i:]
+    } else {
+        name = rest
+    }
+    return name, when, suffix, nil
+}
+
+// gitSelector reports whether the inside of @{...} is one of git's reflog
+// or branch selectors rather than a time: N, -N, upstream/u or push.
+func gitSelector(when string) bool {
+    if _, err := strconv.Atoi(when); err == nil { return true }
+    switch strings.ToLower(when) {
+    case "u", "upstream", "push":
+        return true
+    }
+    return false
+}
+
+// expandRevName maps aigit shorthands to full refs; other names pass through to git.
+func expandRevName(name string) (string, error) {
+    switch {
+    case name == "ck" || name == "checkpoint" || name == "checkpoints":
+        return ckRef()
+    case name == "live":
+        br, err := currentBranch()
+        if err != nil { return "", err }
+        return liveLocalRef(br), nil
+    case strings.HasPrefix(name, "user:"):
+        br, err := currentBranch()
+        if err != nil { return "", err }
+        remote := defaultStr(getGitConfig("aigit.pullRemote"), "origin")
+        return remoteTrackingLiveRef(remote, strings.TrimPrefix(name, "user:"), br), nil
+    }
+    // Named checkpoints on the current branch
+    if br, err := currentBranch(); err == nil {
+        if _, err := git("rev-parse", "-q", "--verify", tagRef(br, name)+"^{commit}"); err == nil {
+            return tagRef(br, name), nil
+        }
+    }
+    return name, nil
+}
+
+// parseAge parses relative ages such as 30s, 10m, 2h, 3d or 1w.
+func parseAge(s string) (time.Duration, error) {
+    s = strings.TrimSpace(s)
+    if d, err := time.ParseDuration(s); err == nil { return d, nil }
+    if len(s) > 1 {
+        if n, err := strconv.Atoi(s[:len(s)-1]); err == nil {
+            switch s[len(s)-1] {
+            case 'd':
+                return time.Duration(n) * 24 * time.Hour, nil
+            case 'w':
+                return time.Duration(n) * 7 * 24 * time.Hour, nil
+            }
+        }
+    }
+    return 0, fmt.Errorf("invalid age %q (use e.g. 10m, 2h, 3d)", s)
+}
+
+// parseWhen parses a time selector: a relative age (10m, 2h, 3d), a local
+// date and time (2026-10-17 14:00, 2026-10-17T14:00:05, RFC 3339), or
+// anything git's date parser understands (yesterday, noon, 3 hours ago).
+// A bare date means that day at the current time of day, as in git.
+func parseWhen(s string) (time.Time, error) {
+    s = strings.TrimSpace(s)
+    now := time.Now()
+    if d, err := parseAge(s); err == nil { return now.Add(-d), nil }
+    if t, err := time.Parse(time.RFC3339, s); err == nil { return t, nil }
+    for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+        if t, err := time.ParseInLocation(layout, s, time.Local); err == nil { return t, nil }
+    }
+    if d, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+        return time.Date(d.Year(), d.Month(), d.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.Local), nil
+    }
+    // git maps text it cannot parse to "now", so only trust it when it moved
+    out, err := git("rev-parse", "--since="+s)
+    if err == nil {
+        if secs, err := strconv.ParseInt(strings.TrimPrefix(out, "--max-age="), 10, 64); err == nil {
+            t := time.Unix(secs, 0)
+            if s == "now" || now.Sub(t).Abs() > 2*time.Second { return t, nil }
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q (use e.g. 10m, 2h, yesterday, 2026-10-17 14:00)", s)
+}
+
+// snapshotAt returns the newest snapshot on any of refs taken at or before
+// t, by its Aigit-When trailer (or commit time when it has none).
+func snapshotAt(refs []string, t time.Time) (string, error) {
+    var best string
+    var bestTime time.Time
+    for _, ref := range refs {
+        out, err := git("log", "--first-parent", "--format=%H%x09%ct%x09%(trailers:key=Aigit-When,valueonly,separator=%x2C)", ref, "--")
+        if err != nil { continue }
+        for _, line := range strings.Split(out, "\n") {
+            parts := strings.SplitN(strings.TrimSpace(line), "\t", 3)
+            if len(parts) < 2 { continue }
+            ct, _ := strconv.ParseInt(parts[1], 10, 64)
+            when := time.Unix(ct, 0)
+            if len(parts) == 3 {
+                if w, err := time.Parse(time.RFC3339, parts[2]); err == nil { when = w }
+            }
+            if when.After(t) { continue }
+            if best == "" || when.After(bestTime) { best, bestTime = parts[0], when }
+            break
+        }
+    }
+    if best == "" {
+        return "", fmt.Errorf("no snapshot on %s before %s", strings.Join(refs, " or "), t.Local().Format("2006-01-02 15:04:05"))
+    }
+    return best, nil
+}
+
+// treeish returns something git diff can compare: the commit, or a freshly
+// written tree of the worktree.
+func (r rev) treeish() (string, error) {
+    if r.Worktree { return snapshotTree() }
+    return r.Commit, nil
+}
+
+// latestSnapshot returns the newer of the checkpoint and live tips.
+func latestSnapshot() (rev, error) {
+    var best rev
+    var bestTime int64 = -1
+    for _, name := range []string{"ck", "live"} {
+        r, err := resolveRev(name)
+        if err != nil { continue }
+        out, err := git("log", "-1", "--format=%ct", r.Commit)
+        if err != nil { continue }
+        ct, _ := strconv.ParseInt(out, 10, 64)
+        if ct > bestTime { best, bestTime = r, ct }
+    }
+    if bestTime < 0 { return rev{}, fmt.Errorf("no checkpoints yet") }
+    return best, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- aigit search ----
+
+type searchOptions struct {
+    Text   string // subject substring (case-insensitive)
+    S      string // pickaxe: occurrences of a literal string changed
+    G      string // pickaxe: added/removed lines match a regex
+    User   string // only this user's snapshots
+    Since  string // age (10m, 3d) or any date git understands
+    Branch string // default: current branch
+    Limit  int
+}
+
+// searchSource is one snapshot chain that can be searched.
+type searchSource struct {
+    Label string // ck, live, <user>/live, <user>/checkpoints
+    Ref   string
+    User  string
+}
+
+type searchHit struct {
+    Source  searchSource
+    Sha     string
+    Time    time.Time
+    Subject string
+    Present bool // pickaxe: the string is in this snapshot after the change
+}
+
+// searchSources lists local and fetched teammate chains for branch.
+func searchSources(branch, user string) ([]searchSource, error) {
+    self := getUserID()
+    var sources []searchSource
+    if user == "" || user == self {
+        sources = append(sources,
+            searchSource{Label: "ck", Ref: refRoot() + "checkpoints/" + refBranch(branch), User: self},
+            searchSource{Label: "live", Ref: liveLocalRef(branch), User: self})
+    }
+    out, err := git("for-each-ref", "--format=%(refname)", "refs/remotes/")
+    if err != nil { return nil, err }
+    for _, ref := range strings.Fields(out) {
+        // refs/remotes/<remote>/aigit/users/<user>/(checkpoints|live)/<branch>
+        parts := strings.Split(ref, "/")
+        if len(parts) != 8 || parts[3] != "aigit" || parts[4] != "users" { continue }
+        if parts[6] != "checkpoints" && parts[6] != "live" { continue }
+        if parts[7] != refBranch(branch) { continue }
+        if user != "" && parts[5] != user { continue }
+        sources = append(sources, searchSource{Label: parts[5] + "/" + parts[6], Ref: ref, User: parts[5]})
+    }
+    var existing []searchSource
+    for _, s := range sources {
+        if _, err := git("rev-parse", "-q", "--verify", s.Ref+"^{commit}"); err == nil { existing = append(existing, s) }
+    }
+    return existing, nil
+}
+
+// sinceArg turns an age like 10m into an absolute date for git log --since.
+func sinceArg(since string) string {
+    if d, err := parseAge(since); err == nil {
+        return time.Now().Add(-d).Format(time.RFC3339)
+    }
+    return since
+}
+
+// searchHits runs the search over every source and returns the hits, newest
+// first, with the branch searched and the sources found on it.
+func searchHits(opts searchOptions) (string, []searchSource, []searchHit, error) {
+    if opts.Text == "" && opts.S == "" && opts.G == "" {
+        return "", nil, nil, errors.New("usage: aigit search <text> | -S <string> | -G <regex> [--user id] [--since 2h] [--branch name] [--json]")
+    }
+    br := opts.Branch
+    if br == "" {
+        var err error
+        if br, err = currentBranch(); err != nil { return "", nil, nil, err }
+    }
+    sources, err := searchSources(br, opts.User)
+    if err != nil { return br, nil, nil, err }
+    var hits []searchHit
+    for _, src := range sources {
+        args := []string{"log", "--first-parent", "--format=%H%x09%ct%x09%s"}
+        if opts.Since != "" { args = append(args, "--since="+sinceArg(opts.Since)) }
+        if opts.S != "" { args = append(args, "-S"+opts.S) }
+        if opts.G != "" { args = append(args, "-G"+opts.G) }
+        out, err := git(append(args, src.Ref)...)
+        if err != nil { return br, sources, nil, err }
+        for _, line := range strings.Split(out, "\n") {
+            parts := strings.SplitN(line, "\t", 3)
+            if len(parts) < 3 { continue }
+            if opts.Text != "" && !strings.Contains(strings.ToLower(parts[2]), strings.ToLower(opts.Text)) { continue }
+            ct, _ := strconv.ParseInt(parts[1], 10, 64)
+            h := searchHit{Source: src, Sha: parts[0], Time: time.Unix(ct, 0), Subject: parts[2]}
+            if opts.S != "" || opts.G != "" { h.Present = contentPresent(h.Sha, opts) }
+            hits = append(hits, h)
+        }
+    }
+    sort.SliceStable(hits, func(i, j int) bool { return hits[i].Time.After(hits[j].Time) })
+    return br, sources, hits, nil
+}
+
+func doSearch(opts searchOptions) error {
+    br, sources, hits, err := searchHits(opts)
+    if err != nil { return err }
+    if len(sources) == 0 {
+        fmt.Printf("No snapshots to search on %s.\n", br)
+        return nil
+    }
+    if len(hits) == 0 {
+        fmt.Println("No matching checkpoints.")
+        return nil
+    }
+    shown := hits
+    if opts.Limit > 0 && len(shown) > opts.Limit { shown = shown[:opts.Limit] }
+    for _, h := range shown {
+        mark := ""
+        if opts.S != "" || opts.G != "" {
+            mark = "- "
+            if h.Present { mark = "+ " }
+        }
+        fmt.Printf("%s%s  %6s  %-20s %s\n", mark, short(h.Sha), relTime(time.Since(h.Time)), "["+h.Source.Label+"]", h.Subject)
+    }
+    if opts.S != "" || opts.G != "" {
+        if first, last, ok := pickaxeSpan(hits); ok {
+            fmt.Println("")
+            fmt.Printf("First seen: %s  %s  [%s] %s\n", short(first.Sha), first.Time.Format(time.RFC3339), first.Source.Label, first.Subject)
+            fmt.Printf("Last seen:  %s  %s  [%s] %s\n", short(last.Sha), last.Time.Format(time.RFC3339), last.Source.Label, last.Subject)
+        }
+    }
+    return nil
+}
+
+// contentPresent reports whether the snapshot contains the searched content.
+func contentPresent(sha string, opts searchOptions) bool {
+    var err error
+    if opts.S != "" {
+        _, err = git("grep", "-q", "-F", "-e", opts.S, sha)
+    } else {
+        _, err = git("grep", "-q", "-E", "-e", opts.G, sha)
+    }
+    return err == nil
+}
+
+// pickaxeSpan finds the oldest snapshot where the content appeared and the
+// newest snapshot that still contained it. hits are newest first.
+func pickaxeSpan(hits []searchHit) (first, last searchHit, ok bool) {
+    for i := len(hits) - 1; i >= 0; i-- {
+        if hits[i].Present { first, ok = hits[i], true; break }
+    }
+    if !ok { return first, last, false }
+    newest := hits[0]
+    if newest.Present {
+        // Still present at the newest change: the chain tip still has it
+        last = newest
+        if tip, err := git("rev-parse", newest.Source.Ref); err == nil && tip != newest.Sha {
+            if out, err := git("log", "-1", "--format=%ct%x09%s", tip); err == nil {
+                parts := strings.SplitN(out, "\t", 2)
+                ct, _ := strconv.ParseInt(parts[0], 10, 64)
+                last = searchHit{Source: newest.Source, Sha: tip, Time: time.Unix(ct, 0)}
+                if len(parts) > 1 { last.Subject = parts[1] }
+            }
+        }
+        return first, last, true
+    }
+    // Removed by the newest change: the snapshot before it was the last to contain it
+    if out, err := git("log", "-1", "--format=%H%x09%ct%x09%s", newest.Sha+"^"); err == nil {
+        parts := strings.SplitN(out, "\t", 3)
+        if len(parts) == 3 {
+            ct, _ := strconv.ParseInt(parts[1], 10, 64)
+            return first, searchHit{Source: newest.Source, Sha: parts[0], Time: time.Unix(ct, 0), Subject: parts[2], Present: true}, true
+        }
+    }
+    return first, newest, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// ---- git stash interop ----
+//
+// A stash is a commit W whose tree is the tracked worktree, with parents
+// HEAD, I (the index, itself parented on HEAD) and optionally U (untracked
+// files, parentless). Snapshots hold tracked and untracked files in one tree
+// plus the index in Aigit-Index, so both directions are a matter of
+// splitting or merging trees.
+
+// doStashFromCheckpoint turns a snapshot into a stash entry (stash@{0}).
+func doStashFromCheckpoint(spec string) error {
+    r, err := resolveRev(spec)
+    if err != nil { return err }
+    if r.Worktree { return fmt.Errorf("use git stash to stash the worktree") }
+    body, err := git("show", "-s", "--format=%s%x1f%B", r.Commit)
+    if err != nil { return err }
+    parts := strings.SplitN(body, "\x1f", 2)
+    subject, m := parts[0], parseMeta(parts[len(parts)-1])
+    base, err := git("rev-parse", "-q", "--verify", m.Base+"^{commit}")
+    if err != nil || m.Base == "" {
+        return fmt.Errorf("%s was taken on a commit that is not available (%s); a stash needs its base", short(r.Commit), short(m.Base))
+    }
+    index := m.Index
+    if index == "" {
+        // Nothing recorded: treat the base as the staging area
+        if index, err = git("rev-parse", base+"^{tree}"); err != nil { return err }
+    } else if _, err := git("cat-file", "-e", index+"^{tree}"); err != nil {
+        return fmt.Errorf("staging area %s of %s is no longer in the object store", short(index), short(r.Commit))
+    }
+
+    // Untracked files are the snapshot paths the index does not know about
+    tracked := map[string]bool{}
+    out, err := git("ls-tree", "-r", "-z", "--name-only", index)
+    if err != nil { return err }
+    for _, p := range splitNul(out) { tracked[p] = true }
+    out, err = git("ls-tree", "-r", "-z", r.Commit)
+    if err != nil { return err }
+    var untracked []string
+    var untrackedInfo strings.Builder
+    for _, e := range splitNul(out) {
+        tab := strings.IndexByte(e, '\t')
+        if tab < 0 || tracked[e[tab+1:]] { continue }
+        untracked = append(untracked, e[tab+1:])
+        untrackedInfo.WriteString(e + "\x00")
+    }
+    wTree, err := treeWith(r.Commit, strings.Join(untracked, "\x00"), "update-index", "-z", "--force-remove", "--stdin")
+    if err != nil { return err }
+
+    br, _ := currentBranch()
+    headLine, _ := git("log", "-1", "--format=%h %s", base)
+    iSha, err := gitInput(fmt.Sprintf("index on %s: %s\n", br, headLine), "commit-tree", index, "-p", base)
+    if err != nil { return err }
+    args := []string{"commit-tree", wTree, "-p", base, "-p", iSha}
+    if len(untracked) > 0 {
+        uTree, err := treeWith("", untrackedInfo.String(), "update-index", "-z", "--index-info")
+        if err != nil { return err }
+        uSha, err := gitInput(fmt.Sprintf("untracked files on %s: %s\n", br, headLine), "commit-tree", uTree)
+        if err != nil { return err }
+        args = append(args, "-p", uSha)
+    }
+    msg := fmt.Sprintf("On %s: %s", br, subject)
+    wSha, err := gitInput(msg+"\n", args...)
+    if err != nil { return err }
+    if _, err := git("stash", "store", "-m", msg, wSha); err != nil { return err }
+    fmt.Printf("Stashed %s as stash@{0} (%s): %s\n", short(r.Commit), short(wSha), subject)
+    if len(untracked) > 0 { fmt.Printf("Includes %d untracked files (git stash apply restores them).\n", len(untracked)) }
+    logLine("Stashed %s as stash@{0}  (%s)", short(r.Commit), subject)
+    return nil
+}
+
+// doCheckpointFromStash imports a stash entry into the checkpoint chain.
+func doCheckpointFromStash(stash string) error {
+    w, err := git("rev-parse", "-q", "--verify", stash+"^{commit}")
+    if err != nil { return fmt.Errorf("no stash %s", stash) }
+    parents, err := git("log", "-1", "--format=%P", w)
+    if err != nil { return err }
+    p := strings.Fields(parents)
+    if len(p) < 2 { return fmt.Errorf("%s is not a stash entry", stash) }
+    index, err := git("rev-parse", p[1]+"^{tree}")
+    if err != nil { return err }
+    tree, err := git("rev-parse", w+"^{tree}")
+    if err != nil { return err }
+    if len(p) > 2 {
+        // Fold the untracked files back into the snapshot tree
+        entries, err := git("ls-tree", "-r", "-z", p[2])
+        if err != nil { return err }
+        if tree, err = treeWith(w, entries, "update-index", "-z", "--index-info"); err != nil { return err }
+    }
+    subject, err := git("log", "-1", "--format=%s", w)
+    if err != nil { return err }
+    // "On main: msg" -> "msg"; "WIP on main: ..." stays as is
+    if strings.HasPrefix(subject, "On ") {
+        if i := strings.Index(subject, ": "); i >= 0 { subject = subject[i+2:] }
+    }
+    ref, err := ckRef()
+    if err != nil { return err }
+    sha, err := writeSnapshotToRef(subject, ref, snapshotOptions{Kind: "stash", SummarySource: "stash", Tree: tree, Base: p[0], Index: index, Stash: w})
+    if err != nil { return err }
+    fmt.Printf("Imported %s as checkpoint %s  (%s)\n", stash, short(sha), subject)
+    logLine("Checkpoint: %s  (%s)", sha, subject)
+    return nil
+}
+
+// treeWith loads start (a tree-ish, or nothing) into a scratch index, runs
+// one git command (update-index) on it with stdin, and writes the result.
+func treeWith(start, stdin string, args ...string) (string, error) {
+    tmpdir, err := os.MkdirTemp("", "aigit-stash-*")
+    if err != nil { return "", err }
+    defer os.RemoveAll(tmpdir)
+    env := map[string]string{"GIT_INDEX_FILE": filepath.Join(tmpdir, "index")}
+    if start != "" {
+        if _, err := gitEnv(env, "read-tree", start); err != nil { return "", err }
+    }
+    if _, err := gitEnvInput(env, stdin, args...); err != nil { return "", err }
+    return gitEnv(env, "write-tree")
+}
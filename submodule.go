@@ -0,0 +1,128 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// ---- Submodules (aigit.submodules=recurse) ----
+//
+// Snapshot trees only hold a gitlink per submodule, so work inside one is
+// invisible to them. In recurse mode each submodule is snapshotted into its
+// own repository, on the same kind of chain (checkpoints, live or undo) keyed
+// on the submodule's own branch, and the superproject snapshot records one
+// "Aigit-Submodule: <sha> <path>" trailer per submodule. A clean submodule is
+// recorded at its HEAD instead of getting a new snapshot. Restore, apply and
+// undo follow the trailers, and push/fetch recurse so teammates receive the
+// submodule snapshots too.
+
+// submoduleDepth is > 0 while running inside a submodule, so nested
+// submodules are followed without each needing the setting.
+var submoduleDepth int
+
+func submodulesRecurse() bool {
+    return submoduleDepth > 0 || strings.TrimSpace(getGitConfig("aigit.submodules")) == "recurse"
+}
+
+// submodulePaths lists the checked-out submodules, relative to the top level.
+func submodulePaths() ([]string, error) {
+    top, err := gitTopLevel()
+    if err != nil { return nil, err }
+    out, err := git("-C", top, "ls-files", "-s", "-z")
+    if err != nil { return nil, err }
+    var paths []string
+    for _, e := range splitNul(out) {
+        tab := strings.IndexByte(e, '\t')
+        if tab < 0 || !strings.HasPrefix(e, "160000 ") { continue }
+        p := e[tab+1:]
+        // Uninitialized submodules are empty directories without .git
+        if _, err := os.Stat(filepath.Join(top, filepath.FromSlash(p), ".git")); err != nil { continue }
+        paths = append(paths, p)
+    }
+    return paths, nil
+}
+
+// eachSubmodule runs f with git pointed at every checked-out submodule when
+// recursing. The process keeps its working directory.
+func eachSubmodule(f func(path string) error) error {
+    if !submodulesRecurse() { return nil }
+    paths, err := submodulePaths()
+    if err != nil { return err }
+    top, err := gitTopLevel()
+    if err != nil { return err }
+    prev := gitWorkDir
+    defer func() { gitWorkDir = prev }()
+    for _, p := range paths {
+        gitWorkDir = filepath.Join(top, filepath.FromSlash(p))
+        submoduleDepth++
+        err := f(p)
+        submoduleDepth--
+        if err != nil { return fmt.Errorf("submodule %s: %w", p, err) }
+    }
+    return nil
+}
+
+// snapshotSubmodules snapshots dirty submodules onto the chain targetRef
+// belongs to and returns the Aigit-Submodule trailer lines.
+func snapshotSubmodules(summary, targetRef string, opts snapshotOptions) (string, error) {
+    chain := "checkpoints"
+    if rest := strings.TrimPrefix(targetRef, refRoot()); rest != targetRef {
+        if c, _, ok := strings.Cut(rest, "/"); ok { chain = c }
+    }
+    var meta strings.Builder
+    err := eachSubmodule(func(p string) error {
+        sha, err := revParse("HEAD")
+        if err != nil { return err }
+        if status, err := git("status", "--porcelain"); err != nil {
+            return err
+        } else if status != "" {
+            br, err := currentBranch()
+            if err != nil { return err }
+            sub := snapshotOptions{Kind: opts.Kind, SummarySource: opts.SummarySource, Model: opts.Model}
+            sha, err = writeSnapshotToRef(summary, refRoot()+chain+"/"+refBranch(br), sub)
+            if err != nil && !errors.Is(err, errNoChanges) { return err }
+        }
+        fmt.Fprintf(&meta, "Aigit-Submodule: %s %s\n", sha, p)
+        return nil
+    })
+    return meta.String(), err
+}
+
+// submoduleSnapshots reads the Aigit-Submodule trailers of a snapshot as
+// path -> sha.
+func submoduleSnapshots(sha string) (map[string]string, error) {
+    body, err := commitBody(sha)
+    if err != nil { return nil, err }
+    subs := map[string]string{}
+    for _, v := range parseMeta(body).Submodules {
+        if s, p, ok := strings.Cut(v, " "); ok { subs[p] = s }
+    }
+    return subs, nil
+}
+
+// restoreSubmodules restores each submodule recorded in snapshot sha and
+// returns the touched files with their superproject paths.
+func restoreSubmodules(sha string, opts restoreOptions) ([]fileChange, error) {
+    subs, err := submoduleSnapshots(sha)
+    if err != nil || len(subs) == 0 { return nil, err }
+    var touched []fileChange
+    err = eachSubmodule(func(p string) error {
+        s, ok := subs[p]
+        if !ok { return nil }
+        if _, err := git("cat-file", "-e", s+"^{commit}"); err != nil {
+            fmt.Printf("Skipping submodule %s: snapshot %s is not available here (aigit sync pull fetches it).\n", p, short(s))
+            return nil
+        }
+        changes, err := restoreWorktree(s, restoreOptions{Exact: opts.Exact})
+        for _, c := range changes {
+            c.Path = path.Join(p, c.Path)
+            touched = append(touched, c)
+        }
+        return err
+    })
+    return touched, err
+}
@@ -7,6 +7,7 @@ import (
     "os/exec"
     "os/user"
     "path/filepath"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -102,26 +103,26 @@ func sanitizeID(s string) string {
 }
 
 func userRemoteRef(user, branch string) string {
-    return "refs/aigit/users/" + user + "/checkpoints/" + branch
+    return "refs/aigit/users/" + user + "/checkpoints/" + refBranch(branch)
 }
 
 func remoteTrackingRef(remote, user, branch string) string {
     // Where fetched refs will appear locally
-    return "refs/remotes/" + remote + "/aigit/users/" + user + "/checkpoints/" + branch
+    return "refs/remotes/" + remote + "/aigit/users/" + user + "/checkpoints/" + refBranch(branch)
 }
 
 // ---- Live update refs ----
 
 func liveLocalRef(branch string) string {
-    return "refs/aigit/live/" + branch
+    return refRoot() + "live/" + refBranch(branch)
 }
 
 func userLiveRemoteRef(user, branch string) string {
-    return "refs/aigit/users/" + user + "/live/" + branch
+    return "refs/aigit/users/" + user + "/live/" + refBranch(branch)
 }
 
 func remoteTrackingLiveRef(remote, user, branch string) string {
-    return "refs/remotes/" + remote + "/aigit/users/" + user + "/live/" + branch
+    return "refs/remotes/" + remote + "/aigit/users/" + user + "/live/" + refBranch(branch)
 }
 
 func pushCheckpoints(remote string) error {
@@ -129,38 +130,77 @@ func pushCheckpoints(remote string) error {
     if err != nil { return err }
     localRef, err := ckRef()
     if err != nil { return err }
-    user := getUserID()
+    user := remoteUserID()
     remoteRef := userRemoteRef(user, br)
-    _, err = git("push", "-f", remote, localRef+":"+remoteRef)
-    return err
+    refspecs := []string{localRef + ":" + remoteRef}
+    // Named checkpoints travel with the checkpoints they name
+    if out, _ := git("for-each-ref", "--format=%(refname)", tagPrefix(br)); strings.TrimSpace(out) != "" {
+        refspecs = append(refspecs, tagPrefix(br)+"*:"+userTagRemoteRef(user, br)+"/*")
+    }
+    // Merge/rebase state referenced by the snapshots' Aigit-State trailers
+    if _, err := git("rev-parse", "-q", "--verify", stateRef(br)); err == nil {
+        refspecs = append(refspecs, stateRef(br)+":"+userStateRemoteRef(user, br))
+    }
+    // Staging areas referenced by the Aigit-Index trailers
+    if _, err := revParse(indexRef(br)); err == nil {
+        refspecs = append(refspecs, indexRef(br)+":"+userIndexRemoteRef(user, br))
+    }
+    if _, err = git(append([]string{"push", "-f", remote}, refspecs...)...); err != nil { return err }
+    return eachSubmodule(func(string) error {
+        if !hasRemote(remote) { return nil }
+        if ref, err := ckRef(); err != nil {
+            return err
+        } else if _, err := git("rev-parse", "-q", "--verify", ref); err != nil {
+            return nil
+        }
+        return pushCheckpoints(remote)
+    })
 }
 
 func fetchCheckpoints(remote string) error {
     // Fetch all aigit refs under remote into refs/remotes/<remote>/aigit/*
     // Use a refspec to ensure they are fetched.
-    _, err := git("fetch", remote, "+refs/aigit/*:refs/remotes/"+remote+"/aigit/*")
-    return err
+    if _, err := git("fetch", remote, "+refs/aigit/*:refs/remotes/"+remote+"/aigit/*"); err != nil { return err }
+    return eachSubmodule(func(string) error {
+        if !hasRemote(remote) { return nil }
+        return fetchCheckpoints(remote)
+    })
 }
 
 // pushLive pushes the latest local live ref to the remote per-user live namespace.
 func pushLive(remote string) error {
     br, err := currentBranch()
     if err != nil { return err }
-    user := getUserID()
+    user := remoteUserID()
     local := liveLocalRef(br)
     // Ensure local ref exists; if not, nothing to push
     if _, err := git("rev-parse", "-q", "--verify", local+"^{commit}"); err != nil {
         return nil
     }
-    remoteRef := userLiveRemoteRef(user, br)
-    _, err = git("push", "-f", remote, local+":"+remoteRef)
-    return err
+    refspecs := []string{local + ":" + userLiveRemoteRef(user, br)}
+    if _, err := git("rev-parse", "-q", "--verify", stateRef(br)); err == nil {
+        refspecs = append(refspecs, stateRef(br)+":"+userStateRemoteRef(user, br))
+    }
+    if _, err := revParse(indexRef(br)); err == nil {
+        refspecs = append(refspecs, indexRef(br)+":"+userIndexRemoteRef(user, br))
+    }
+    if _, err = git(append([]string{"push", "-f", remote}, refspecs...)...); err != nil { return err }
+    return eachSubmodule(func(string) error {
+        if !hasRemote(remote) { return nil }
+        return pushLive(remote)
+    })
 }
 
-// fetchLive fetches all users' live refs into tracking refs.
+// fetchLive fetches all users' live refs into tracking refs. A refspec may
+// only hold one "*", so this takes the whole users namespace (live, state
+// and shared checkpoints) in a single fetch.
 func fetchLive(remote string) error {
-    _, err := git("fetch", remote, "+refs/aigit/users/*/live/*:refs/remotes/"+remote+"/aigit/users/*/live/*")
-    return err
+    _, err := git("fetch", remote, "+refs/aigit/users/*:refs/remotes/"+remote+"/aigit/users/*")
+    if err != nil { return err }
+    return eachSubmodule(func(string) error {
+        if !hasRemote(remote) { return nil }
+        return fetchLive(remote)
+    })
 }
 
 func latestRemoteCheckpoint(remote, user, branch string) (string, string, error) {
@@ -171,14 +211,27 @@ func latestRemoteCheckpoint(remote, user, branch string) (string, string, error)
     return sha, subj, nil
 }
 
-func applyRemoteCheckpoint(remote, user, sha string) error {
+func applyRemoteCheckpoint(remote, user, sha string, opts restoreOptions) error {
     br, err := currentBranch()
     if err != nil { return err }
     if strings.TrimSpace(sha) == "" {
         tip, _, err := latestRemoteCheckpoint(remote, user, br)
         if err != nil { return err }
         sha = tip
+    } else if tagged, err := git("rev-parse", "-q", "--verify", remoteTrackingTagRef(remote, user, br, sha)+"^{commit}"); err == nil {
+        // The user's own checkpoint names take precedence
+        sha = tagged
+    } else {
+        // A bare time selector (@{1h}) picks from this user's checkpoints
+        if strings.HasPrefix(sha, "@{") && !gitSelector(strings.TrimSuffix(sha[2:], "}")) { sha = remoteTrackingRef(remote, user, br) + sha }
+        r, err := resolveRev(sha)
+        if err != nil { return err }
+        if r.Worktree { return fmt.Errorf("cannot apply the worktree") }
+        sha = r.Commit
     }
+    st, err := prepareWithState(sha, &opts)
+    if err != nil { return err }
+    if err := applyScope(sha, &opts); err != nil { return err }
     fmt.Printf("Applying %s from %s/%s to worktree...\n", short(sha), remote, user)
     logLine("Applying %s from %s/%s to worktree...", short(sha), remote, user)
     subj, _ := git("log", "-1", "--format=%s", sha)
@@ -186,25 +239,31 @@ func applyRemoteCheckpoint(remote, user, sha string) error {
         fmt.Printf("Summary: %s\n", subj)
         logLine("Summary: %s", subj)
     }
-    if _, err := git("restore", "--worktree", "--source", sha, "--", "."); err != nil {
-        if _, err2 := git("checkout", sha, "--", "."); err2 != nil {
-            return fmt.Errorf("apply failed: %v; fallback checkout failed: %v", err, err2)
-        }
+    cause := fmt.Sprintf("apply %s from %s/%s", short(sha), remote, user)
+    if len(opts.Paths) > 0 { cause += " -- " + strings.Join(opts.Paths, " ") }
+    before, err := saveUndo(cause)
+    if err != nil { return err }
+    opts.Before = before
+    touched, err := restoreWorktree(sha, opts)
+    if err != nil {
+        return fmt.Errorf("apply failed: %w", err)
     }
+    echoFiles(touched, true, true)
+    if err := finishWithState(st); err != nil { return err }
     // Record last applied
-    _ = markApplied(remote, user, br, sha)
+    _ = markApplied(remote, user, br, sha, opts.Paths)
     return nil
 }
 
 func latestRemoteLive(remote, user, branch string) (string, string, error) {
     ref := remoteTrackingLiveRef(remote, user, branch)
-    sha, err := git("rev-parse", "-q", "--verify", ref+"^{commit}")
+    sha, err := revParse(ref + "^{commit}")
     if err != nil { return "", "", err }
     subj, _ := git("log", "-1", "--format=%s", ref)
     return sha, subj, nil
 }
 
-func applyRemoteLive(remote, user, sha string) error {
+func applyRemoteLive(remote, user, sha string, opts restoreOptions) error {
     br, err := currentBranch()
     if err != nil { return err }
     if strings.TrimSpace(sha) == "" {
@@ -219,22 +278,74 @@ func applyRemoteLive(remote, user, sha string) error {
         fmt.Printf("Summary: %s\n", subj)
         logLine("Summary: %s", subj)
     }
-    if _, err := git("restore", "--worktree", "--source", sha, "--", "."); err != nil {
-        if _, err2 := git("checkout", sha, "--", "."); err2 != nil {
-            return fmt.Errorf("apply failed: %v; fallback checkout failed: %v", err, err2)
+    cause := fmt.Sprintf("auto-apply %s from %s/%s", short(sha), remote, user)
+    if len(opts.Paths) > 0 { cause += " -- " + strings.Join(opts.Paths, " ") }
+    before, err := saveUndo(cause)
+    if err != nil { return err }
+    opts.Before = before
+    label := remote + "/" + user
+    base := applyBase(remote, user, br, sha, opts)
+    var touched []fileChange
+    var conflicts []string
+    if base == "" {
+        touched, err = restoreWorktree(sha, opts)
+    } else if touched, conflicts, err = mergeWorktree(base, sha, label, opts); err == nil && len(opts.Paths) == 0 {
+        var subs []fileChange
+        subs, err = restoreSubmodules(sha, opts)
+        touched = append(touched, subs...)
+    }
+    if err != nil {
+        return fmt.Errorf("apply failed: %w", err)
+    }
+    echoFiles(touched, true, true)
+    if len(conflicts) > 0 {
+        msg := conflictReport(applyConflictMode(), label, conflicts)
+        fmt.Println(msg)
+        logLine("%s", msg)
+    }
+    // Record last applied: the next apply merges the changes made since
+    _ = markApplied(remote, user, br, sha, opts.Paths)
+    if base == "" {
+        appliedTree, _ = revParse(sha + "^{tree}")
+    } else if beforeTree, _ := revParse(before + "^{tree}"); beforeTree == lastLiveTree(br) {
+        // Don't echo the merge back as a local change. Local edits that were
+        // not snapshotted yet are, and the merge goes along with them.
+        paths := []string{}
+        for _, c := range touched {
+            paths = append(paths, c.Path)
         }
+        appliedTree, _ = snapshotTreeOf(paths)
+    } else {
+        appliedTree = ""
     }
-    // Record last applied
-    _ = markApplied(remote, user, br, sha)
     // Set a short suppression window for local snapshots to avoid ping-pong
     suppressSnapshots(5)
     return nil
 }
 
+// applyBase picks the base of the three-way merge: the snapshot of user
+// applied last time or, before the first apply, the commit their snapshot
+// was taken on. When neither is in the object store (say they committed
+// without pushing), it falls back to HEAD, so edits made here since HEAD
+// are kept whether or not they were snapshotted. "" means the snapshot is
+// copied as a whole (exact and with-state applies).
+func applyBase(remote, user, branch, sha string, opts restoreOptions) string {
+    if opts.Exact || opts.WithState { return "" }
+    last, _ := lastApplied(remote, user, branch)
+    body, _ := commitBody(sha)
+    for _, base := range []string{last, parseMeta(body).Base} {
+        if base == "" { continue }
+        if c, err := revParse(base + "^{commit}"); err == nil { return c }
+    }
+    if tree, err := revParse("HEAD^{tree}"); err == nil { return tree }
+    return emptyTree
+}
+
 // ---- Auto-apply state ----
 
 type appliedState struct {
-    Items map[string]string `json:"items"` // key -> sha
+    Items   map[string]string   `json:"items"`             // key -> sha
+    Partial map[string][]string `json:"partial,omitempty"` // key -> pathspecs when the last apply was partial
 }
 
 func statePath() (string, error) {
@@ -263,10 +374,19 @@ func saveState(st *appliedState) error {
 
 func key(remote, user, branch string) string { return remote+"|"+user+"|"+branch }
 
-func markApplied(remote, user, branch, sha string) error {
+// markApplied records sha as the last applied snapshot; paths is non-empty
+// when only part of it was applied.
+func markApplied(remote, user, branch, sha string, paths []string) error {
     st, err := loadState()
     if err != nil { return err }
-    st.Items[key(remote, user, branch)] = sha
+    k := key(remote, user, branch)
+    st.Items[k] = sha
+    if len(paths) > 0 {
+        if st.Partial == nil { st.Partial = map[string][]string{} }
+        st.Partial[k] = paths
+    } else {
+        delete(st.Partial, k)
+    }
     return saveState(st)
 }
 
@@ -292,23 +412,25 @@ func maybePullAndAutoApply() error {
     auto := (autoCfg == "" || strings.EqualFold(autoCfg, "true"))
     if !auto { return nil }
     allow := strings.TrimSpace(getGitConfig("aigit.autoApplyFrom"))
+    // Every teammate's live tip in one for-each-ref
+    tips, err := remoteLiveTips(remote, br)
+    if err != nil { return err }
     var users []string
     if allow == "*" || allow == "" {
-        // Apply from all users except self by enumerating refs under remote path
-        list, _ := listRemoteUsers(remote, br)
-        users = list
+        // Apply from all users except self
+        for u := range tips { users = append(users, u) }
+        sort.Strings(users)
     } else {
         users = splitComma(allow)
     }
-    self := getUserID()
+    self, selfWT := getUserID(), remoteUserID()
     for _, u := range users {
-        if u == "" || u == self { continue }
-        tip, _, err := latestRemoteLive(remote, u, br)
-        if err != nil { continue }
+        if u == "" || u == self || u == selfWT { continue }
+        tip := tips[u]
         last, _ := lastApplied(remote, u, br)
         if tip != "" && tip != last {
             // apply
-            if err := applyRemoteLive(remote, u, tip); err != nil {
+            if err := applyRemoteLive(remote, u, tip, restoreOptions{}); err != nil {
                 fmt.Fprintf(os.Stderr, "auto-apply (live) from %s failed: %v\n", u, err)
             } else {
                 fmt.Printf("Auto-applied live %s from %s/%s\n", short(tip), remote, u)
@@ -318,6 +440,19 @@ func maybePullAndAutoApply() error {
     return nil
 }
 
+// remoteLiveTips maps each user with a fetched live ref for branch to its tip.
+func remoteLiveTips(remote, branch string) (map[string]string, error) {
+    prefix := "refs/remotes/" + remote + "/aigit/users/"
+    refs, err := refTips(prefix)
+    if err != nil { return nil, err }
+    tips := map[string]string{}
+    for ref, sha := range refs {
+        user, rest, ok := strings.Cut(strings.TrimPrefix(ref, prefix), "/")
+        if ok && rest == "live/"+refBranch(branch) { tips[user] = sha }
+    }
+    return tips, nil
+}
+
 func listRemoteUsers(remote, branch string) ([]string, error) {
     // Enumerate refs under refs/remotes/<remote>/aigit/users/*/(live|checkpoints)/<branch>
     prefix := "refs/remotes/"+remote+"/aigit/users/"
@@ -328,9 +463,9 @@ func listRemoteUsers(remote, branch string) ([]string, error) {
         if line == "" { continue }
         // Expect refs/remotes/<remote>/aigit/users/<user>/(checkpoints|live)/<branch>
         parts := strings.Split(line, "/")
-        if len(parts) < 7 { continue }
+        if len(parts) != 8 { continue }
         user := parts[5]
-        if (parts[6] == "checkpoints" || parts[6] == "live") && len(parts) >= 8 && parts[7] == branch {
+        if (parts[6] == "checkpoints" || parts[6] == "live") && parts[7] == refBranch(branch) {
             set[user] = struct{}{}
         }
     }
@@ -350,6 +485,12 @@ func splitComma(s string) []string {
 
 // hasRemote reports if the given git remote exists
 func hasRemote(name string) bool {
+    if values, err := configValues(); err == nil {
+        for k := range values {
+            if strings.HasPrefix(k, "remote."+name+".") { return true }
+        }
+        return false
+    }
     out, err := git("remote")
     if err != nil { return false }
     for _, ln := range strings.Split(strings.TrimSpace(out), "\n") {
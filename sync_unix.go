@@ -3,6 +3,7 @@
 package main
 
 import (
+    "errors"
     "os"
     "os/exec"
     "syscall"
@@ -23,3 +24,16 @@ func isAlive(pid int) bool {
     }
     return true
 }
+
+// pidAlive reports whether pid is running. A process of another user
+// counts as running.
+func pidAlive(pid int) (alive, known bool) {
+    if pid <= 0 { return false, false }
+    err := syscall.Kill(pid, 0)
+    return err == nil || errors.Is(err, syscall.EPERM), true
+}
+
+// shellCommand runs command through the user's POSIX shell.
+func shellCommand(command string) *exec.Cmd {
+    return exec.Command("sh", "-c", command)
+}
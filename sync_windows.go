@@ -13,3 +13,14 @@ func isAlive(pid int) bool {
     // Users can remove .git/aigit/watch.pid to force a restart.
     return true
 }
+
+// pidAlive cannot tell on Windows (see isAlive); callers fall back to
+// other evidence.
+func pidAlive(pid int) (alive, known bool) {
+    return false, false
+}
+
+// shellCommand runs command through cmd.exe.
+func shellCommand(command string) *exec.Cmd {
+    return exec.Command("cmd", "/C", command)
+}
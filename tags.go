@@ -0,0 +1,108 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// ---- Named checkpoints ----
+//
+// Tags live at refs/aigit/tags/<branch>/<name> (under refRoot, with the
+// branch escaped by refBranch). They resolve anywhere a sha is accepted and
+// pin their snapshot against gc rewrites.
+
+// tagPrefix is the directory holding branch's tags.
+func tagPrefix(branch string) string {
+    return tagPrefixIn(refRoot(), branch)
+}
+
+// tagPrefixIn is tagPrefix under another ref root (see refRootFor).
+func tagPrefixIn(root, branch string) string {
+    return root + "tags/" + refBranch(branch) + "/"
+}
+
+func tagRef(branch, name string) string {
+    return tagPrefix(branch) + name
+}
+
+func userTagRemoteRef(user, branch string) string {
+    return "refs/aigit/users/" + user + "/tags/" + refBranch(branch)
+}
+
+func remoteTrackingTagRef(remote, user, branch, name string) string {
+    return "refs/remotes/" + remote + "/aigit/users/" + user + "/tags/" + refBranch(branch) + "/" + name
+}
+
+// validateTagName rejects names that cannot be used as a ref component.
+func validateTagName(name string) error {
+    name = strings.TrimSpace(name)
+    if name == "" || strings.ContainsAny(name, "@{}~^:") {
+        return fmt.Errorf("invalid tag name %q", name)
+    }
+    if _, err := git("check-ref-format", "refs/aigit/tags/"+name); err != nil {
+        return fmt.Errorf("invalid tag name %q", name)
+    }
+    return nil
+}
+
+// createTag points a tag at the snapshot spec resolves to.
+func createTag(spec, name string) error {
+    if err := validateTagName(name); err != nil { return err }
+    r, err := resolveRev(spec)
+    if err != nil { return err }
+    if r.Worktree { return fmt.Errorf("cannot tag the worktree; checkpoint it first") }
+    br, err := currentBranch()
+    if err != nil { return err }
+    if _, err := git("update-ref", "-m", "aigit: tag "+name, tagRef(br, name), r.Commit); err != nil { return err }
+    subj, _ := git("log", "-1", "--format=%s", r.Commit)
+    fmt.Printf("Tagged %s as %s  (%s)\n", short(r.Commit), name, subj)
+    logLine("Tagged %s as %s  (%s)", short(r.Commit), name, subj)
+    return nil
+}
+
+func deleteTag(name string) error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    ref := tagRef(br, name)
+    if _, err := git("rev-parse", "-q", "--verify", ref); err != nil { return fmt.Errorf("no tag %q on %s", name, br) }
+    if _, err := git("update-ref", "-d", ref); err != nil { return err }
+    fmt.Printf("Deleted tag %s\n", name)
+    return nil
+}
+
+// branchTags maps snapshot shas to their tag names on branch.
+func branchTags(branch string) map[string][]string {
+    return tagsUnder(tagPrefix(branch))
+}
+
+// tagsUnder maps snapshot shas to the names of the tags below prefix.
+func tagsUnder(prefix string) map[string][]string {
+    tags := map[string][]string{}
+    out, err := git("for-each-ref", "--format=%(objectname) %(refname)", prefix)
+    if err != nil { return tags }
+    for _, line := range strings.Split(out, "\n") {
+        parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+        if len(parts) < 2 { continue }
+        name := strings.TrimPrefix(parts[1], prefix)
+        tags[parts[0]] = append(tags[parts[0]], name)
+    }
+    return tags
+}
+
+func doTagList() error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    prefix := tagPrefix(br)
+    out, err := git("for-each-ref", "--format=%(objectname:short)%09%(refname)%09%(contents:subject)", prefix)
+    if err != nil { return err }
+    if strings.TrimSpace(out) == "" {
+        fmt.Println("No tags yet.")
+        return nil
+    }
+    for _, line := range strings.Split(out, "\n") {
+        parts := strings.SplitN(line, "\t", 3)
+        if len(parts) < 3 { continue }
+        fmt.Printf("%-20s %s  %s\n", strings.TrimPrefix(parts[1], prefix), parts[0], parts[2])
+    }
+    return nil
+}
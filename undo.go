@@ -0,0 +1,79 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ---- Undo stack for destructive worktree operations ----
+//
+// Before restore/apply touches the worktree, the current state is snapshotted
+// onto refs/aigit/undo/<branch>. Each commit on that chain is one undo entry;
+// its subject records the operation that caused it.
+
+func undoRef(branch string) string {
+    return refRoot() + "undo/" + refBranch(branch)
+}
+
+// saveUndo snapshots the worktree before a destructive operation described by cause.
+func saveUndo(cause string) (string, error) {
+    br, err := currentBranch()
+    if err != nil { return "", err }
+    sha, err := writeSnapshotToRef(cause, undoRef(br), snapshotOptions{Kind: "undo", SummarySource: "aigit"})
+    if err != nil { return "", fmt.Errorf("safety snapshot failed (worktree left untouched): %w", err) }
+    logLine("Undo point: %s  (%s)", short(sha), cause)
+    return sha, nil
+}
+
+// doUndo rolls the worktree back to the most recent undo entry and pops it.
+func doUndo() error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    ref := undoRef(br)
+    top, err := git("rev-parse", "-q", "--verify", ref+"^{commit}")
+    if err != nil { return errors.New("nothing to undo") }
+    cause, _ := git("log", "-1", "--format=%s", top)
+    fmt.Printf("Undoing %s (restoring worktree to %s)...\n", cause, short(top))
+    touched, err := restoreWorktree(top, restoreOptions{Exact: true})
+    if err != nil { return err }
+    echoFiles(touched, true, false)
+    // Bring back the staging area too, in case the undone operation reset it
+    if body, err := commitBody(top); err == nil && parseMeta(body).Index != "" {
+        if err := restoreIndex(top, restoreOptions{Exact: true}); err != nil { return err }
+    }
+    // Pop the entry
+    if parent, err := git("rev-parse", "-q", "--verify", top+"^1"); err == nil {
+        _, err = git("update-ref", "-m", "aigit: undo", ref, parent, top)
+        if err != nil { return err }
+    } else {
+        if _, err := git("update-ref", "-d", ref, top); err != nil { return err }
+    }
+    logLine("Undone: %s  (%s)", short(top), cause)
+    fmt.Println("Done.")
+    return nil
+}
+
+// doUndoList prints the undo stack, most recent first.
+func doUndoList(limit int) error {
+    br, err := currentBranch()
+    if err != nil { return err }
+    ref := undoRef(br)
+    if _, err := git("rev-parse", "-q", "--verify", ref); err != nil {
+        fmt.Println("Undo stack is empty.")
+        return nil
+    }
+    out, err := git("--no-pager", "log", "-n", strconv.Itoa(limit), "--format=%h%x09%ct%x09%s", ref)
+    if err != nil { return err }
+    for i, line := range strings.Split(out, "\n") {
+        parts := strings.SplitN(line, "\t", 3)
+        if len(parts) < 3 { continue }
+        ct, _ := strconv.ParseInt(parts[1], 10, 64)
+        marker := " "
+        if i == 0 { marker = "*" }
+        fmt.Printf("%s %s  %6s  before %s\n", marker, parts[0], relTime(time.Since(time.Unix(ct, 0))), parts[2])
+    }
+    return nil
+}
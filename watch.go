@@ -4,15 +4,66 @@ import (
     "fmt"
     "os"
     "path/filepath"
+    "sort"
     "strings"
+    "sync"
 
     fsnotify "github.com/fsnotify/fsnotify"
 )
 
+// maxChangedPaths bounds pathSet; past it the next snapshot rescans everything.
+const maxChangedPaths = 1000
+
+// pathSet collects the paths (relative to the top level) the fs watcher saw
+// change since the last snapshot, so the snapshot only rescans those.
+type pathSet struct {
+    mu    sync.Mutex
+    paths map[string]bool
+    all   bool
+}
+
+// newPathSet starts out needing a full scan: nothing is known about changes
+// made before the watcher started.
+func newPathSet() *pathSet {
+    return &pathSet{paths: map[string]bool{}, all: true}
+}
+
+func (s *pathSet) add(p string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.all { return }
+    s.paths[p] = true
+    if len(s.paths) > maxChangedPaths { s.all = true }
+}
+
+// markAll makes the next snapshot a full scan.
+func (s *pathSet) markAll() {
+    s.mu.Lock()
+    s.all = true
+    s.mu.Unlock()
+}
+
+// take empties the set. It returns nil when a full scan is needed.
+func (s *pathSet) take() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var paths []string
+    if !s.all {
+        paths = []string{}
+        for p := range s.paths {
+            paths = append(paths, p)
+        }
+        sort.Strings(paths)
+    }
+    s.paths, s.all = map[string]bool{}, false
+    return paths
+}
+
 // startFsWatch starts a recursive fsnotify watcher rooted at dir.
-// It sends a signal on 'events' when any relevant filesystem change occurs.
+// It sends a signal on 'events' when any relevant filesystem change occurs
+// and records the changed path in changed (if non-nil).
 // Returns a stop function.
-func startFsWatch(root string, events chan<- struct{}) (func() error, error) {
+func startFsWatch(root string, events chan<- struct{}, changed *pathSet) (func() error, error) {
     w, err := fsnotify.NewWatcher()
     if err != nil {
         return nil, err
@@ -65,6 +116,13 @@ func startFsWatch(root string, events chan<- struct{}) (func() error, error) {
                         _ = addDir(ev.Name)
                     }
                 }
+                if changed != nil {
+                    if rel, err := filepath.Rel(root, ev.Name); err == nil {
+                        changed.add(filepath.ToSlash(rel))
+                    } else {
+                        changed.markAll()
+                    }
+                }
                 // coalesce bursts by delaying a small amount handled in main loop
                 emit()
             case err, ok := <-w.Errors:
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+// ---- git worktree support ----
+//
+// Watcher state (pid, log, applied.json) lives in aigitDir, which is under
+// the per-worktree git dir, so every linked worktree runs its own watcher.
+// Refs are shared by default: each worktree usually has its own branch and
+// therefore its own chains. With aigit.worktreeRefs=true a linked worktree
+// keeps its refs under refs/aigit/worktrees/<name>/ and shares them as the
+// remote user <user>+<name>, so checkouts of the same branch or commit
+// never write to the same chain.
+
+// worktreeName returns the linked worktree's name (its admin dir under
+// .git/worktrees), or "" in the main worktree.
+func worktreeName() string {
+    p, err := repoInfo()
+    if err != nil { return "" }
+    return linkedName(p.GitDir, p.CommonDir)
+}
+
+// linkedName derives the worktree name from its absolute git dir and
+// common dir.
+func linkedName(gitDir, commonDir string) string {
+    if filepath.Clean(gitDir) == filepath.Clean(commonDir) { return "" }
+    return filepath.Base(gitDir)
+}
+
+func worktreeRefsEnabled() bool {
+    return strings.EqualFold(strings.TrimSpace(getGitConfig("aigit.worktreeRefs")), "true")
+}
+
+// refRoot is the prefix of this worktree's aigit refs.
+func refRoot() string {
+    return refRootFor(worktreeName())
+}
+
+func refRootFor(name string) string {
+    if name == "" || !worktreeRefsEnabled() { return "refs/aigit/" }
+    return "refs/aigit/worktrees/" + name + "/"
+}
+
+// remoteUserID is the user id this worktree's refs are shared under.
+func remoteUserID() string {
+    if name := worktreeName(); name != "" && worktreeRefsEnabled() {
+        return getUserID() + "+" + sanitizeID(name)
+    }
+    return getUserID()
+}
+
+type worktreeInfo struct {
+    Path, Name, Branch string
+    Current            bool
+}
+
+// listWorktrees parses `git worktree list --porcelain`.
+func listWorktrees() ([]worktreeInfo, error) {
+    out, err := git("worktree", "list", "--porcelain")
+    if err != nil { return nil, err }
+    top, _ := gitTopLevel()
+    var list []worktreeInfo
+    for i, block := range strings.Split(out, "\n\n") {
+        var wt worktreeInfo
+        var head string
+        bare := false
+        for _, line := range strings.Split(strings.TrimSpace(block), "\n") {
+            k, v, _ := strings.Cut(line, " ")
+            switch k {
+            case "worktree":
+                wt.Path = v
+            case "HEAD":
+                head = v
+            case "branch":
+                wt.Branch = strings.TrimPrefix(v, "refs/heads/")
+            case "bare":
+                bare = true
+            }
+        }
+        if wt.Path == "" || bare { continue }
+        if wt.Branch == "" && head != "" { wt.Branch = detachedPrefix + head }
+        if i > 0 {
+            // Linked worktrees: the name is their admin dir under .git/worktrees
+            dirs, err := git("-C", wt.Path, "rev-parse", "--path-format=absolute", "--git-dir", "--git-common-dir")
+            if err != nil { continue }
+            if d := strings.Split(dirs, "\n"); len(d) == 2 { wt.Name = linkedName(d[0], d[1]) }
+        }
+        wt.Current = filepath.Clean(wt.Path) == filepath.Clean(top)
+        list = append(list, wt)
+    }
+    return list, nil
+}
+
+// doListWorktrees lists the checkpoints of every worktree of the repo.
+func doListWorktrees(limit int, showMeta bool) error {
+    wts, err := listWorktrees()
+    if err != nil { return err }
+    for i, wt := range wts {
+        if i > 0 { fmt.Println("") }
+        label := wt.Path
+        if wt.Name != "" { label += " (" + wt.Name + ")" }
+        if wt.Current { label += "  *" }
+        fmt.Printf("%s  [%s]\n", label, wt.Branch)
+        root := refRootFor(wt.Name)
+        ck := root + "checkpoints/" + refBranch(wt.Branch)
+        if _, err := git("rev-parse", "-q", "--verify", ck); err != nil {
+            fmt.Println("  No checkpoints yet.")
+        } else if err := printSnapshots(ck, limit, showMeta, tagsUnder(tagPrefixIn(root, wt.Branch)), "  "); err != nil {
+            return err
+        }
+        if out, err := git("log", "-1", "--format=%h%x09%s", root+"live/"+refBranch(wt.Branch)); err == nil {
+            if parts := strings.SplitN(out, "\t", 2); len(parts) == 2 {
+                fmt.Printf("  live: %s  %s\n", parts[0], parts[1])
+            }
+        }
+    }
+    return nil
+}